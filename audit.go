@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// auditEntry is one line of a JSONL audit log.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Key       string    `json:"key"`
+	VersionId string    `json:"versionId,omitempty"`
+	Size      int64     `json:"size"`
+	RequestId string    `json:"requestId,omitempty"`
+	Hash      string    `json:"hash"`
+}
+
+// auditLog records every deleted object, with the ID of the request that
+// deleted it, for --auditLog. It's JSONL if the path ends in .jsonl or
+// .ndjson and CSV otherwise, and is only ever appended to.
+//
+// Each record carries a hash chained from the one before it, so editing or
+// removing a record breaks every hash after it. Writes may come from several
+// batches at once.
+type auditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	buf  *bufio.Writer
+	csv  *csv.Writer
+	json *json.Encoder
+	prev string
+}
+
+// auditTail is how much of an existing audit log is read to find the last
+// record, which comfortably holds a record with the longest possible key.
+const auditTail = 64 << 10
+
+func openAuditLog(path string) (*auditLog, error) {
+	isJSON := false
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		isJSON = true
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	a := &auditLog{f: f, buf: bufio.NewWriter(f)}
+	if a.prev, err = lastAuditHash(f, isJSON); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if isJSON {
+		a.json = json.NewEncoder(a.buf)
+	} else {
+		a.csv = csv.NewWriter(a.buf)
+		if info.Size() == 0 {
+			a.csv.Write([]string{"time", "key", "versionId", "size", "requestId", "hash"})
+		}
+	}
+	return a, nil
+}
+
+// lastAuditHash returns the hash of the last record in an existing audit
+// log, so a later run continues its chain, or "" for a new log.
+func lastAuditHash(f *os.File, isJSON bool) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to read audit log: %w", err)
+	}
+	offset := max(0, info.Size()-auditTail)
+	tail := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read audit log: %w", err)
+	}
+	tail = bytes.TrimRight(tail, "\r\n")
+	if len(tail) == 0 {
+		return "", nil
+	}
+
+	if !isJSON {
+		return lastCSVHash(tail, offset > 0)
+	}
+	var entry auditEntry
+	if err := json.Unmarshal(tail[bytes.LastIndexByte(tail, '\n')+1:], &entry); err != nil {
+		return "", fmt.Errorf("failed to read the last record of the audit log: %w", err)
+	}
+	return entry.Hash, nil
+}
+
+// lastCSVHash returns the hash of the last record in the tail of a CSV audit
+// log. Quoted keys may hold line breaks, so a tail that starts partway
+// through the log is parsed from the first line break after which the rest
+// reads as whole records.
+func lastCSVHash(tail []byte, partial bool) (string, error) {
+	for start := 0; ; {
+		if partial {
+			i := bytes.IndexByte(tail[start:], '\n')
+			if i < 0 {
+				break
+			}
+			start += i + 1
+		}
+		if hash, ok := csvRecordsHash(tail[start:]); ok {
+			return hash, nil
+		}
+		if !partial {
+			break
+		}
+	}
+	return "", fmt.Errorf("failed to read the last record of the audit log")
+}
+
+// csvRecordsHash parses data as whole audit log records, returning the hash
+// of the last one ("" if it's just the header) and whether it parsed.
+func csvRecordsHash(data []byte) (string, bool) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = 6
+	hash := ""
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return hash, true
+		}
+		if err != nil {
+			return "", false
+		}
+		if record[0] == "time" && record[5] == "hash" {
+			hash = ""
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record[0]); err != nil {
+			return "", false
+		}
+		if h, err := hex.DecodeString(record[5]); err != nil || len(h) != sha256.Size {
+			return "", false
+		}
+		hash = record[5]
+	}
+}
+
+// record appends the objects deleted by a request. It's a no-op without
+// --auditLog.
+func (a *auditLog) record(objects []object, requestId string) error {
+	if a == nil || len(objects) == 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, obj := range objects {
+		entry := auditEntry{
+			Time:      now,
+			Key:       aws.ToString(obj.Key),
+			VersionId: aws.ToString(obj.VersionId),
+			Size:      obj.Size,
+			RequestId: requestId,
+		}
+		entry.Hash = a.chain(entry)
+		a.prev = entry.Hash
+
+		var err error
+		if a.json != nil {
+			err = a.json.Encode(entry)
+		} else {
+			err = a.csv.Write([]string{entry.Time.Format(time.RFC3339Nano), entry.Key, entry.VersionId, strconv.FormatInt(entry.Size, 10), entry.RequestId, entry.Hash})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+	// Keep the log complete up to the last finished batch
+	if a.csv != nil {
+		a.csv.Flush()
+		if err := a.csv.Error(); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+	if err := a.buf.Flush(); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// chain hashes a record together with the hash of the one before it: the
+// SHA-256 of the previous hash and the record's fields as written, each
+// preceded by its length in bytes and a colon, since keys may contain any
+// character.
+func (a *auditLog) chain(entry auditEntry) string {
+	h := sha256.New()
+	for _, field := range []string{a.prev, entry.Time.Format(time.RFC3339Nano), entry.Key, entry.VersionId, strconv.FormatInt(entry.Size, 10), entry.RequestId} {
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordAudit adds objects deleted by a request to the audit log, if any,
+// given the request's response metadata. The run is aborted if it can't be
+// written, since deletions would otherwise go unrecorded.
+func (p *purger) recordAudit(objects []object, metadata middleware.Metadata) {
+	if p.audit == nil {
+		return
+	}
+	requestId, _ := awsmiddleware.GetRequestIDMetadata(metadata)
+	if err := p.audit.record(objects, requestId); err != nil {
+		p.abort(err)
+	}
+}
+
+// close syncs and closes the audit log. It's a no-op without --auditLog, and
+// safe to call more than once.
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	f := a.f
+	a.f = nil
+	if err := a.buf.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// defaultBatchSize is the batch size for providers without a preset,
+	// which most S3-compatible gateways accept
+	defaultBatchSize = 500
+	// maxBatchSize is the most keys DeleteObjects accepts
+	maxBatchSize = 1000
+)
+
+// batchSizePresets are the default batch sizes for providers known to
+// accept full DeleteObjects requests, by endpoint host suffix.
+var batchSizePresets = map[string]int{
+	"amazonaws.com":            maxBatchSize,
+	"r2.cloudflarestorage.com": maxBatchSize,
+}
+
+// parseBatchSize returns --batchSize, or the preset for the endpoint's
+// provider if it isn't set.
+func parseBatchSize(c *cli.Context) (int, error) {
+	if c.IsSet("batchSize") {
+		n := c.Int("batchSize")
+		if n < 1 || n > maxBatchSize {
+			return 0, fmt.Errorf("--batchSize must be in the range [1, %d]", maxBatchSize)
+		}
+		return n, nil
+	}
+	// Several endpoints are gateways of the same cluster, so the first
+	// stands for all of them
+	endpoints := c.StringSlice("endpoint")
+	if len(endpoints) == 0 {
+		return defaultBatchSize, nil
+	}
+	if u, err := url.Parse(endpoints[0]); err == nil {
+		host := strings.ToLower(u.Hostname())
+		for suffix, n := range batchSizePresets {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return n, nil
+			}
+		}
+	}
+	return defaultBatchSize, nil
+}
+
+// tooManyKeysCodes are error codes some providers return for a DeleteObjects
+// request with more keys, or a bigger body, than they accept.
+var tooManyKeysCodes = map[string]bool{
+	"EntityTooLarge":           true,
+	"RequestEntityTooLarge":    true,
+	"MaxMessageLengthExceeded": true,
+	"TooManyKeys":              true,
+}
+
+// batchTooLarge reports whether a DeleteObjects call failed because the
+// batch was bigger than the provider allows.
+func batchTooLarge(err error) bool {
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusRequestEntityTooLarge {
+		return true
+	}
+	if tooManyKeysCodes[errorCode(err)] {
+		return true
+	}
+	switch errorCode(err) {
+	case "InvalidArgument", "InvalidRequest":
+		msg := strings.ToLower(err.Error())
+		return strings.Contains(msg, "too many") || strings.Contains(msg, "more objects than allowed") ||
+			strings.Contains(msg, "max keys") || strings.Contains(msg, "maximum number of keys")
+	}
+	return false
+}
+
+// batchLimit is the most objects sent in one DeleteObjects call, which starts
+// at the configured batch size and only ever shrinks.
+func (p *purger) batchLimit() int {
+	if n := p.maxBatch.Load(); n > 0 {
+		return int(n)
+	}
+	return p.batchSize
+}
+
+// shrinkBatch lowers the batch limit to size, unless another batch has
+// already lowered it further.
+func (p *purger) shrinkBatch(size int) {
+	for {
+		current := p.maxBatch.Load()
+		if current > 0 && current <= int64(size) {
+			return
+		}
+		if p.maxBatch.CompareAndSwap(current, int64(size)) {
+			slog.Warn("Provider rejected the batch size, sending smaller batches from now on", "batchSize", size)
+			return
+		}
+	}
+}
+
+// splitBatch halves a batch the provider rejected as too large, remembers
+// the smaller size for the rest of the run and deletes the halves in turn.
+// Each half is tracked by the wait group like any other batch.
+func (p *purger) splitBatch(objects []object, attempt int) {
+	size := (len(objects) + 1) / 2
+	p.shrinkBatch(size)
+	size = min(size, p.batchLimit())
+
+	var chunks [][]object
+	for len(objects) > 0 {
+		n := min(size, len(objects))
+		chunks = append(chunks, objects[:n:n])
+		objects = objects[n:]
+	}
+	p.wg.Add(len(chunks))
+	for _, chunk := range chunks {
+		p.deleteObjects(chunk, attempt)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/urfave/cli/v2"
+)
+
+// benchCommand is `s3purge bench`, which times deletions of scratch objects
+// at several settings to find the fastest ones for an endpoint. It shares
+// the connection flags of the main command, which go before "bench".
+func benchCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "bench",
+		Usage: "Time deletions at several --concurrency and --batchSize settings under a scratch prefix and report the fastest",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "prefix",
+				Usage: "Empty prefix to write the scratch objects under",
+				Value: "s3purge-bench/",
+			},
+			&cli.IntFlag{
+				Name:  "objects",
+				Usage: "Number of objects to delete at each setting",
+				Value: 10000,
+			},
+			&cli.IntSliceFlag{
+				Name:  "concurrencies",
+				Usage: "Concurrency levels to try",
+				Value: cli.NewIntSlice(16, 64, 256),
+			},
+			&cli.IntSliceFlag{
+				Name:  "batchSizes",
+				Usage: "Batch sizes to try",
+				Value: cli.NewIntSlice(100, 500, 1000),
+			},
+		},
+		Action: runBench,
+	}
+}
+
+// benchResult is the outcome of deleting the scratch objects at one setting.
+type benchResult struct {
+	concurrency int
+	batchSize   int
+	deleted     uint64
+	failed      uint64
+	throttled   uint64
+	elapsed     time.Duration
+}
+
+func (r benchResult) rate() float64 {
+	return float64(r.deleted) / r.elapsed.Seconds()
+}
+
+func runBench(c *cli.Context) error {
+	ctx, stop := interruptContext()
+	defer stop()
+	bucketName := c.String("bucket")
+	prefix := c.String("prefix")
+	objects := c.Int("objects")
+	concurrencies := c.IntSlice("concurrencies")
+	batchSizes := c.IntSlice("batchSizes")
+
+	if err := checkProtected(c, bucketName); err != nil {
+		return err
+	}
+	if prefix == "" {
+		return fmt.Errorf("bench needs a --prefix to write scratch objects under")
+	}
+	if objects < 1 {
+		return fmt.Errorf("--objects must be at least 1")
+	}
+	for _, n := range concurrencies {
+		if n < 1 {
+			return fmt.Errorf("--concurrencies must all be at least 1")
+		}
+	}
+	for _, n := range batchSizes {
+		if n < 1 || n > maxBatchSize {
+			return fmt.Errorf("--batchSizes must all be in the range [1, %d]", maxBatchSize)
+		}
+	}
+
+	svc, err := newS3Client(c)
+	if err != nil {
+		return err
+	}
+	if err := refuseVersioned(ctx, svc, bucketName, false); err != nil {
+		return err
+	}
+
+	// Everything under the prefix is deleted afterwards, so it has to
+	// start out empty
+	output, err := svc.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: &bucketName, Prefix: &prefix, MaxKeys: 1})
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	if len(output.Contents) > 0 {
+		return fmt.Errorf("prefix %q isn't empty, bench needs a scratch prefix of its own", prefix)
+	}
+	// Clean up even once interrupted, which only a second signal stops
+	defer benchCleanup(context.WithoutCancel(ctx), svc, bucketName, prefix)
+
+	var results []benchResult
+	for _, batchSize := range batchSizes {
+		for _, concurrency := range concurrencies {
+			run := fmt.Sprintf("%s%d-%d/", prefix, batchSize, concurrency)
+			slog.Info("Writing scratch objects", "prefix", run, "objects", objects)
+			keys, err := benchUpload(ctx, svc, bucketName, run, objects, concurrency)
+			if ctx.Err() != nil {
+				return cli.Exit("s3purge: interrupted before the bench finished", exitInterrupted)
+			}
+			if err != nil {
+				return err
+			}
+			slog.Info("Deleting scratch objects", "concurrency", concurrency, "batchSize", batchSize)
+			result := benchDelete(ctx, svc, bucketName, keys, batchSize, concurrency)
+			if ctx.Err() != nil {
+				return cli.Exit("s3purge: interrupted before the bench finished", exitInterrupted)
+			}
+			slog.Info(fmt.Sprintf("Deleted %d objects in %s (%.1f objects/second)", result.deleted, result.elapsed.Round(time.Millisecond), result.rate()),
+				"failed", result.failed, "throttled", result.throttled)
+			results = append(results, result)
+		}
+	}
+
+	printBenchResults(results)
+	return nil
+}
+
+// benchUpload writes empty scratch objects under the prefix and returns
+// their keys.
+func benchUpload(ctx context.Context, svc *s3.Client, bucketName, prefix string, n, concurrency int) ([]string, error) {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s%08d", prefix, i)
+	}
+
+	var wg sync.WaitGroup
+	var failed atomic.Pointer[error]
+	sem := make(chan struct{}, concurrency)
+	for _, key := range keys {
+		if failed.Load() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			_, err := svc.PutObject(ctx, &s3.PutObjectInput{Bucket: &bucketName, Key: &key, Body: strings.NewReader("")})
+			if err != nil {
+				err = fmt.Errorf("failed to write scratch object %s: %w", key, err)
+				failed.CompareAndSwap(nil, &err)
+			}
+		}(key)
+	}
+	wg.Wait()
+	if err := failed.Load(); err != nil {
+		return nil, *err
+	}
+	return keys, nil
+}
+
+// benchDelete times deleting the keys in batches, with up to concurrency
+// DeleteObjects calls in flight.
+func benchDelete(ctx context.Context, svc *s3.Client, bucketName string, keys []string, batchSize, concurrency int) benchResult {
+	result := benchResult{concurrency: concurrency, batchSize: batchSize}
+	var deleted, failed, throttled atomic.Uint64
+
+	batches := make(chan []string)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				identifiers := make([]types.ObjectIdentifier, len(batch))
+				for i := range batch {
+					identifiers[i] = types.ObjectIdentifier{Key: aws.String(batch[i])}
+				}
+				output, err := svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+					Bucket: &bucketName,
+					Delete: &types.Delete{Objects: identifiers, Quiet: true},
+				})
+				var keyErrors []types.Error
+				if output != nil {
+					keyErrors = output.Errors
+				}
+				if slow, _ := slowDown(err, keyErrors); slow {
+					throttled.Add(1)
+				}
+				if err != nil {
+					failed.Add(uint64(len(batch)))
+					continue
+				}
+				failed.Add(uint64(len(keyErrors)))
+				deleted.Add(uint64(len(batch) - len(keyErrors)))
+			}
+		}()
+	}
+	for len(keys) > 0 && ctx.Err() == nil {
+		n := min(batchSize, len(keys))
+		batches <- keys[:n]
+		keys = keys[n:]
+	}
+	close(batches)
+	wg.Wait()
+
+	result.elapsed = time.Since(start)
+	result.deleted, result.failed, result.throttled = deleted.Load(), failed.Load(), throttled.Load()
+	return result
+}
+
+// benchCleanupAttempts bounds how many times benchCleanup sends the keys
+// that failed to delete.
+const benchCleanupAttempts = 3
+
+// benchCleanup deletes whatever is left under the scratch prefix, such as
+// objects that failed to delete during a run. Keys that still fail are
+// logged so they can be removed by hand.
+func benchCleanup(ctx context.Context, svc *s3.Client, bucketName, prefix string) {
+	paginator := s3.NewListObjectsV2Paginator(svc, &s3.ListObjectsV2Input{Bucket: &bucketName, Prefix: &prefix})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			slog.Error("failed to list leftover scratch objects", "prefix", prefix, "error", err)
+			return
+		}
+		if len(output.Contents) == 0 {
+			continue
+		}
+		identifiers := make([]types.ObjectIdentifier, len(output.Contents))
+		for i := range output.Contents {
+			identifiers[i] = types.ObjectIdentifier{Key: output.Contents[i].Key}
+		}
+		for attempt := 1; len(identifiers) > 0; attempt++ {
+			if attempt > 1 {
+				time.Sleep(time.Duration(attempt-1) * time.Second)
+			}
+			deleted, err := svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				Bucket: &bucketName,
+				Delete: &types.Delete{Objects: identifiers, Quiet: true},
+			})
+			if err != nil {
+				slog.Error("failed to delete leftover scratch objects", "prefix", prefix, "error", err)
+				return
+			}
+			if attempt == benchCleanupAttempts {
+				for _, e := range deleted.Errors {
+					slog.Error("failed to delete leftover scratch object", "key", aws.ToString(e.Key), "code", aws.ToString(e.Code), "error", aws.ToString(e.Message))
+				}
+				break
+			}
+			identifiers = identifiers[:0]
+			for _, e := range deleted.Errors {
+				identifiers = append(identifiers, types.ObjectIdentifier{Key: e.Key})
+			}
+		}
+	}
+}
+
+// printBenchResults writes the results, fastest first, and recommends the
+// fastest setting that ran without errors or throttling.
+func printBenchResults(results []benchResult) {
+	sort.Slice(results, func(i, j int) bool { return results[i].rate() > results[j].rate() })
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "CONCURRENCY\tBATCH SIZE\tOBJECTS/S\tFAILED\tTHROTTLED\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%d\t%d\t%.1f\t%d\t%d\t\n", r.concurrency, r.batchSize, r.rate(), r.failed, r.throttled)
+	}
+	tw.Flush()
+
+	for _, r := range results {
+		if r.failed == 0 && r.throttled == 0 {
+			fmt.Printf("\nFastest clean setting: --concurrency %d --batchSize %d\n", r.concurrency, r.batchSize)
+			return
+		}
+	}
+	fmt.Println("\nEvery setting failed or was throttled, try lower --concurrencies")
+}
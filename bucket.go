@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// deleteBucketAttempts bounds how many times the bucket is re-scanned and
+// purged again before giving up on deleting it.
+const deleteBucketAttempts = 5
+
+// deleteBucketRetryDelay is how long to wait before re-scanning a bucket
+// that still has contents, e.g. objects written while it was being purged
+// or deletions that were slow to become visible.
+const deleteBucketRetryDelay = 2 * time.Second
+
+// deleteBucket deletes the bucket once it has been verified empty of
+// objects, versions, delete markers and multipart uploads. Anything found on
+// a re-scan is purged again, unfiltered, before retrying.
+func deleteBucket(ctx context.Context, p *purger, aborted *atomic.Uint64) error {
+	for attempt := 1; ; attempt++ {
+		empty, err := bucketEmpty(ctx, p)
+		if err != nil {
+			return err
+		}
+		if empty {
+			_, err = p.svc.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: &p.bucketName})
+			if err == nil {
+				slog.Info("Deleted bucket", "bucket", p.bucketName)
+				return nil
+			}
+			var apiErr smithy.APIError
+			if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "BucketNotEmpty" {
+				return fmt.Errorf("failed to delete bucket: %w", err)
+			}
+		}
+		if attempt == deleteBucketAttempts {
+			return fmt.Errorf("bucket %s still isn't empty after %d attempts, check the filters and for concurrent writers", p.bucketName, attempt)
+		}
+
+		slog.Warn("Bucket isn't empty yet, re-scanning", "attempt", attempt)
+		time.Sleep(deleteBucketRetryDelay)
+		// Whatever is left has to go for the bucket to be deleted, even if
+		// it was written within --safetyMinAge, and the checkpoint would
+		// only say the listing is already finished
+		p.filter = &objectFilter{maxSize: -1, now: p.filter.now}
+		p.checkpoint = nil
+		if err := listPrefix(ctx, p, ""); err != nil {
+			return err
+		}
+		p.wait()
+		if err := abortMultipartUploads(ctx, p, "", aborted); err != nil {
+			return err
+		}
+	}
+}
+
+// bucketEmpty reports whether the bucket holds no versions, delete markers
+// or incomplete multipart uploads.
+func bucketEmpty(ctx context.Context, p *purger) (bool, error) {
+	versions, err := p.svc.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{
+		Bucket:  &p.bucketName,
+		MaxKeys: 1,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list object versions: %w", err)
+	}
+	if len(versions.Versions) > 0 || len(versions.DeleteMarkers) > 0 {
+		return false, nil
+	}
+
+	uploads, err := p.svc.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{
+		Bucket:     &p.bucketName,
+		MaxUploads: 1,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list multipart uploads: %w", err)
+	}
+	return len(uploads.Uploads) == 0, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Batches and their DeleteObjects identifiers are recycled rather than
+// allocated afresh for every batch, since at tens of thousands of deletes a
+// second the garbage collector otherwise dominates CPU time.
+var (
+	batchPool      sync.Pool // *[]object
+	identifierPool sync.Pool // *[]types.ObjectIdentifier
+)
+
+// newBatch returns an empty batch with room for n objects.
+func newBatch(n int) []object {
+	if b, ok := batchPool.Get().(*[]object); ok && cap(*b) >= n {
+		return (*b)[:0]
+	}
+	return make([]object, 0, n)
+}
+
+// releaseBatch recycles a batch once nothing refers to it any more, i.e. it
+// isn't being retried or split. Batches that are subslices of another must
+// have their capacity capped, so a recycled one can't grow into its
+// neighbour.
+func releaseBatch(objects []object) {
+	clear(objects[:cap(objects)]) // Don't hold on to the keys
+	objects = objects[:0]
+	batchPool.Put(&objects)
+}
+
+// identifiersFor returns the DeleteObjects identifiers of a batch. They must
+// be released once the request is done with.
+func identifiersFor(objects []object) []types.ObjectIdentifier {
+	var identifiers []types.ObjectIdentifier
+	if b, ok := identifierPool.Get().(*[]types.ObjectIdentifier); ok && cap(*b) >= len(objects) {
+		identifiers = (*b)[:len(objects)]
+	} else {
+		identifiers = make([]types.ObjectIdentifier, len(objects))
+	}
+	for i := range objects {
+		identifiers[i] = objects[i].identifier()
+	}
+	return identifiers
+}
+
+func releaseIdentifiers(identifiers []types.ObjectIdentifier) {
+	clear(identifiers[:cap(identifiers)])
+	identifiers = identifiers[:0]
+	identifierPool.Put(&identifiers)
+}
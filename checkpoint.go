@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const checkpointVersion = 1
+
+// checkpointState is the on-disk form of a checkpoint: how far the listing
+// of each prefix has got, plus the progress made so far.
+type checkpointState struct {
+	Version   int                        `json:"version"`
+	Bucket    string                     `json:"bucket"`
+	Versioned bool                       `json:"versioned"`
+	Updated   time.Time                  `json:"updated"`
+	Prefixes  map[string]*prefixPosition `json:"prefixes"`
+	Deleted   uint64                     `json:"deleted"`
+	Bytes     uint64                     `json:"bytes"`
+	// Directory markers held back by --directoryMarkers last
+	Markers []checkpointMarker `json:"markers,omitempty"`
+}
+
+// prefixPosition is how far the listing of a prefix has got. Every key up to
+// and including After has been dealt with.
+type prefixPosition struct {
+	After string `json:"after,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+}
+
+type checkpointMarker struct {
+	Key       string `json:"key"`
+	VersionId string `json:"versionId,omitempty"`
+}
+
+// checkpointer periodically saves listing positions to a state file, so an
+// interrupted purge can pick up where it left off with --resume. A nil
+// checkpointer does nothing.
+//
+// A position is only saved once every object listed up to it has been
+// deleted, so the purger is drained before each save. Sources advance their
+// position after submitting a page, so a save never gets ahead of them.
+type checkpointer struct {
+	path string
+
+	mu    sync.Mutex
+	state checkpointState
+	// Progress from earlier runs, which the purger's own stats don't include
+	deleted uint64
+	bytes   uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// openCheckpoint starts a new checkpoint at path, or with resume continues
+// from the one already there. It refuses to overwrite an existing
+// checkpoint without resume.
+func openCheckpoint(path, bucketName string, versioned, resume bool) (*checkpointer, error) {
+	cp := &checkpointer{
+		path: path,
+		state: checkpointState{
+			Version:   checkpointVersion,
+			Bucket:    bucketName,
+			Versioned: versioned,
+			Prefixes:  map[string]*prefixPosition{},
+		},
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if resume {
+			return nil, fmt.Errorf("no checkpoint to resume from at %s", path)
+		}
+		return cp, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	case !resume:
+		return nil, fmt.Errorf("checkpoint %s already exists, pass --resume to continue from it or remove it to start over", path)
+	}
+
+	var state checkpointState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %w", path, err)
+	}
+	switch {
+	case state.Version != checkpointVersion:
+		return nil, fmt.Errorf("checkpoint %s has unsupported version %d", path, state.Version)
+	case state.Bucket != bucketName:
+		return nil, fmt.Errorf("checkpoint %s is for bucket %q, not %q", path, state.Bucket, bucketName)
+	case state.Versioned != versioned:
+		return nil, fmt.Errorf("checkpoint %s was taken listing %s, pass the same options to resume", path, listingKind(state.Versioned))
+	}
+	if state.Prefixes == nil {
+		state.Prefixes = map[string]*prefixPosition{}
+	}
+	cp.state = state
+	cp.deleted, cp.bytes = state.Deleted, state.Bytes
+	slog.Info("Resuming from checkpoint", "path", path, "updated", state.Updated, "prefixes", len(state.Prefixes), "deleted", state.Deleted)
+	return cp, nil
+}
+
+func listingKind(versioned bool) string {
+	if versioned {
+		return "object versions"
+	}
+	return "current objects"
+}
+
+// resumeAfter returns the key to resume listing the prefix after, and
+// whether the prefix has already been listed completely.
+func (cp *checkpointer) resumeAfter(prefix string) (string, bool) {
+	if cp == nil {
+		return "", false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	pos := cp.state.Prefixes[prefix]
+	if pos == nil {
+		return "", false
+	}
+	return pos.After, pos.Done
+}
+
+// advance records that every key of the prefix up to and including after
+// has been submitted.
+func (cp *checkpointer) advance(prefix, after string) {
+	if cp == nil || after == "" {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.position(prefix).After = after
+}
+
+// finish records that the prefix has been listed completely.
+func (cp *checkpointer) finish(prefix string) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.position(prefix).Done = true
+}
+
+func (cp *checkpointer) position(prefix string) *prefixPosition {
+	pos := cp.state.Prefixes[prefix]
+	if pos == nil {
+		pos = &prefixPosition{}
+		cp.state.Prefixes[prefix] = pos
+	}
+	return pos
+}
+
+// markers returns the directory markers held back by an earlier run.
+func (cp *checkpointer) markers() []object {
+	if cp == nil {
+		return nil
+	}
+	markers := make([]object, len(cp.state.Markers))
+	for i, m := range cp.state.Markers {
+		markers[i] = keyVersionObject(m.Key, m.VersionId)
+	}
+	return markers
+}
+
+// run drains the purger and saves the checkpoint every interval until
+// close is called.
+func (cp *checkpointer) run(p *purger, interval time.Duration) {
+	if cp == nil {
+		return
+	}
+	cp.stop = make(chan struct{})
+	cp.done = make(chan struct{})
+	go func() {
+		defer close(cp.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-cp.stop:
+				return
+			}
+			p.mu.Lock()
+			// Batch goroutines never take mu, so it's safe to wait for
+			// them here, as the canary does
+			p.flushLocked()
+			p.wg.Wait()
+			markers := append([]object(nil), p.markers...)
+			p.mu.Unlock()
+			if err := cp.save(p, markers); err != nil {
+				slog.Error("Failed to save checkpoint", "err", err)
+			}
+		}
+	}()
+}
+
+// close stops the periodic saves and saves the final state. Deletions must
+// have completed.
+func (cp *checkpointer) close(p *purger) error {
+	if cp == nil {
+		return nil
+	}
+	if cp.stop != nil {
+		close(cp.stop)
+		<-cp.done
+	}
+	if err := cp.save(p, p.markers); err != nil {
+		return err
+	}
+	slog.Info("Saved checkpoint", "path", cp.path)
+	return nil
+}
+
+// totals returns the objects and bytes deleted across every run.
+func (cp *checkpointer) totals(p *purger) (uint64, uint64) {
+	return cp.deleted + p.stats.deleted.Load(), cp.bytes + p.stats.bytes.Load()
+}
+
+// save writes the checkpoint to a temporary file and renames it into place,
+// so a crash mid-write leaves the previous checkpoint intact.
+func (cp *checkpointer) save(p *purger, markers []object) error {
+	cp.mu.Lock()
+	cp.state.Updated = time.Now().UTC()
+	cp.state.Deleted, cp.state.Bytes = cp.totals(p)
+	cp.state.Markers = cp.state.Markers[:0]
+	for _, m := range markers {
+		cp.state.Markers = append(cp.state.Markers, checkpointMarker{Key: aws.ToString(m.Key), VersionId: aws.ToString(m.VersionId)})
+	}
+	data, err := json.MarshalIndent(cp.state, "", "  ")
+	cp.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := cp.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, cp.path); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
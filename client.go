@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/time/rate"
+)
+
+// newS3Client builds the S3 client from the endpoint, credential, retry and
+// connection flags. Requests are spread across the endpoints if there are
+// several.
+func newS3Client(c *cli.Context) (*s3.Client, error) {
+	endpoints, err := newEndpointPool(c.StringSlice("endpoint"))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadSDKConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	// Set after loading, so the clients the SDK makes for credentials (SSO,
+	// STS) keep their own endpoints
+	cfg.EndpointResolver = endpoints
+
+	if len(endpoints.endpoints) > 1 {
+		cfg.HTTPClient = &endpointHealthClient{HTTPClient: cfg.HTTPClient, pool: endpoints}
+	}
+	if rps := c.Float64("maxRps"); rps > 0 {
+		cfg.HTTPClient = &rateLimitedClient{HTTPClient: cfg.HTTPClient, limiter: rate.NewLimiter(rate.Limit(rps), max(1, int(rps)))}
+	}
+
+	switch v := c.String("signatureVersion"); v {
+	case "v4", "v2":
+	default:
+		return nil, fmt.Errorf("--signatureVersion must be v4 or v2, not %q", v)
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if c.String("signatureVersion") == "v2" {
+			o.APIOptions = append(o.APIOptions, sigV2Middleware(o.Credentials))
+		}
+		if c.String("metricsAddr") != "" {
+			o.APIOptions = append(o.APIOptions, s3Requests.middleware)
+		}
+		if c.String("otlpEndpoint") != "" {
+			o.APIOptions = append(o.APIOptions, tracingMiddleware)
+		}
+		if c.Bool("traceHttp") {
+			o.APIOptions = append(o.APIOptions, httpLogMiddleware)
+		}
+	}), nil
+}
+
+// loadSDKConfig loads the SDK config from the credential, retry and
+// connection flags, for the S3 client and any other AWS service used along
+// with it.
+func loadSDKConfig(c *cli.Context) (aws.Config, error) {
+	credentials, err := credentialOptions(c)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	retryer, err := newSDKRetryer(c.String("sdkRetryMode"), c.Int("sdkMaxAttempts"), c.Duration("sdkMaxBackoff"))
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	httpClient, err := newHTTPClient(c)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	options := append(credentials, config.WithRetryer(retryer), config.WithHTTPClient(httpClient))
+	for attempt := 0; ; attempt++ {
+		cfg, err := config.LoadDefaultConfig(context.TODO(), options...)
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("unable to load SDK config: %w", err)
+		}
+		if from := c.String("credentialsFrom"); from != "" {
+			if cfg.Credentials, err = secretStoreCredentials(from, cfg); err != nil {
+				return aws.Config{}, err
+			}
+		}
+		if c.String("roleArn") != "" {
+			cfg.Credentials = assumeRole(c, cfg)
+		}
+		if c.Bool("anonymous") {
+			return cfg, nil
+		}
+		// Find out about unusable credentials before anything else
+		creds, err := cfg.Credentials.Retrieve(context.TODO())
+		if err != nil {
+			// An expired SSO sign-in can be renewed there and then
+			if login := ssoLoginFor(context.TODO(), c); attempt == 0 && login != nil && login.expired() {
+				if err := login.run(context.TODO(), cfg.HTTPClient); err != nil {
+					return aws.Config{}, err
+				}
+				continue
+			}
+			return aws.Config{}, fmt.Errorf("failed to get credentials: %w", err)
+		}
+		slog.Debug("Got credentials", "source", creds.Source, "accessKey", redact(creds.AccessKeyID))
+		return cfg, nil
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "github.com/urfave/cli/v2"
+
+// countCommand lists and filters like a purge, but only counts the matching
+// objects and bytes to size the job.
+func countCommand() *cli.Command {
+	return &cli.Command{
+		Name:   "count",
+		Usage:  "Only count the matching objects and bytes to size the job, without deleting anything",
+		Action: runPurge,
+	}
+}
+
+// counting reports whether this run is the count command rather than a
+// purge.
+func counting(c *cli.Context) bool {
+	return c.Command != nil && c.Command.Name == "count"
+}
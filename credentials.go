@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/urfave/cli/v2"
+)
+
+// credentialOptions returns the SDK config options for the credentials
+// chosen by the flags: a static key pair (temporary, with a session token),
+// a profile from the shared config and credentials files, or otherwise the
+// SDK's default chain (environment variables, the default profile, web
+// identity tokens, ECS task roles and EC2 instance roles). A web identity
+// token file needs no base credentials, and --anonymous none at all; keys
+// from --credentialsFrom replace the loaded ones later.
+func credentialOptions(c *cli.Context) ([]func(*config.LoadOptions) error, error) {
+	var keys [3]string
+	for i, name := range []string{"accessKey", "secretKey", "sessionToken"} {
+		var err error
+		if keys[i], err = flagOrFile(c, name); err != nil {
+			return nil, err
+		}
+	}
+	accessKeyID, secretAccessKey, sessionToken := keys[0], keys[1], keys[2]
+	profile := c.String("profile")
+
+	if c.String("roleArn") == "" {
+		for _, name := range []string{"externalId", "sessionName", "stsEndpoint", "webIdentityTokenFile"} {
+			if c.IsSet(name) {
+				return nil, fmt.Errorf("--%s requires --roleArn", name)
+			}
+		}
+	}
+	if c.IsSet("credentialsFrom") {
+		for _, name := range []string{"accessKey", "secretKey", "sessionToken", "anonymous", "webIdentityTokenFile"} {
+			if c.IsSet(name) || c.IsSet(name+"File") {
+				return nil, fmt.Errorf("--credentialsFrom can't be used with --%s", name)
+			}
+		}
+	}
+	if c.Bool("anonymous") {
+		for _, name := range []string{"accessKey", "secretKey", "sessionToken", "profile", "roleArn"} {
+			if c.IsSet(name) || c.IsSet(name+"File") {
+				return nil, fmt.Errorf("--anonymous can't be used with --%s", name)
+			}
+		}
+		// Requests aren't signed at all
+		return []func(*config.LoadOptions) error{config.WithCredentialsProvider(aws.AnonymousCredentials{})}, nil
+	}
+	switch {
+	case (accessKeyID == "") != (secretAccessKey == ""):
+		return nil, fmt.Errorf("--accessKey and --secretKey must be given together")
+	case sessionToken != "" && accessKeyID == "":
+		return nil, fmt.Errorf("--sessionToken requires --accessKey and --secretKey")
+	case accessKeyID != "" && profile != "":
+		return nil, fmt.Errorf("--profile can't be used with --accessKey and --secretKey")
+	case c.IsSet("webIdentityTokenFile") && (accessKeyID != "" || profile != ""):
+		return nil, fmt.Errorf("--webIdentityTokenFile can't be used with --accessKey and --secretKey or --profile")
+	case c.IsSet("webIdentityTokenFile") && c.IsSet("externalId"):
+		return nil, fmt.Errorf("--externalId can't be used with --webIdentityTokenFile")
+	case accessKeyID != "":
+		return []func(*config.LoadOptions) error{
+			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, sessionToken)),
+		}, nil
+	case profile != "":
+		return []func(*config.LoadOptions) error{config.WithSharedConfigProfile(profile)}, nil
+	}
+	return nil, nil
+}
+
+// assumeRole returns credentials for --roleArn, obtained from STS and
+// renewed as they expire: with the base credentials in cfg, or in exchange
+// for the token in --webIdentityTokenFile, which is read afresh each time so
+// that rotated tokens are picked up. STS is reached at its usual AWS
+// endpoint rather than --endpoint, unless --stsEndpoint is given.
+func assumeRole(c *cli.Context, cfg aws.Config) aws.CredentialsProvider {
+	stsCfg := cfg.Copy()
+	if stsCfg.Region == "" {
+		stsCfg.Region = "us-east-1"
+	}
+	client := sts.NewFromConfig(stsCfg, func(o *sts.Options) {
+		if endpoint := c.String("stsEndpoint"); endpoint != "" {
+			o.BaseEndpoint = &endpoint
+		}
+	})
+	if path := c.String("webIdentityTokenFile"); path != "" {
+		return aws.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(client, c.String("roleArn"), stscreds.IdentityTokenFile(path), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = c.String("sessionName")
+		}))
+	}
+	return aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(client, c.String("roleArn"), func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = c.String("sessionName")
+		if id := c.String("externalId"); id != "" {
+			o.ExternalID = &id
+		}
+	}))
+}
+
+// flagOrFile returns the value of a credential flag, or else the contents of
+// the file given by its File variant, so the secret needn't be on the command
+// line where ps and shell history would see it.
+func flagOrFile(c *cli.Context, name string) (string, error) {
+	path := c.String(name + "File")
+	if path == "" {
+		return c.String(name), nil
+	}
+	if c.IsSet(name) {
+		return "", fmt.Errorf("--%s can't be used with --%sFile", name, name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read --%sFile: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// redact hides all but the end of a credential for logging.
+func redact(s string) string {
+	if len(s) <= 8 {
+		return "****"
+	}
+	return "****" + s[len(s)-4:]
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// endpointMaxFailures is how many requests in a row may fail against an
+	// endpoint before it's taken out of the rotation
+	endpointMaxFailures = 3
+	// endpointCooldown is how long an unhealthy endpoint is left out
+	endpointCooldown = 30 * time.Second
+)
+
+// endpointNames describes the --endpoint flags for logs, prompts and plans.
+func endpointNames(c *cli.Context) string {
+	return strings.Join(c.StringSlice("endpoint"), ",")
+}
+
+// endpointPool spreads requests across several gateways of the same
+// cluster, round-robin. Endpoints whose requests keep failing to get an
+// answer are skipped for a while, unless every endpoint is failing.
+//
+// The endpoint is picked when a request is built, since it's part of the
+// signature, and the outcome is reported back by endpointHealthClient,
+// which recognizes the endpoint by its host.
+type endpointPool struct {
+	endpoints []*poolEndpoint
+	next      atomic.Uint64
+}
+
+type poolEndpoint struct {
+	url  string
+	host string
+
+	mu        sync.Mutex
+	failures  int
+	downUntil time.Time
+}
+
+func newEndpointPool(urls []string) (*endpointPool, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("--endpoint is required")
+	}
+	pool := &endpointPool{}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid --endpoint %q", raw)
+		}
+		pool.endpoints = append(pool.endpoints, &poolEndpoint{url: raw, host: strings.ToLower(u.Host)})
+	}
+	return pool, nil
+}
+
+// ResolveEndpoint implements aws.EndpointResolver.
+func (p *endpointPool) ResolveEndpoint(service, region string) (aws.Endpoint, error) {
+	return aws.Endpoint{URL: p.pick().url}, nil
+}
+
+// pick returns the next healthy endpoint, or the next one regardless if
+// none are healthy.
+func (p *endpointPool) pick() *poolEndpoint {
+	start := p.next.Add(1)
+	now := time.Now()
+	for i := range p.endpoints {
+		e := p.endpoints[(start+uint64(i))%uint64(len(p.endpoints))]
+		if e.healthy(now) {
+			return e
+		}
+	}
+	return p.endpoints[start%uint64(len(p.endpoints))]
+}
+
+func (e *poolEndpoint) healthy(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !now.Before(e.downUntil)
+}
+
+// record notes the outcome of a request to the host. With virtual-hosted
+// addressing the bucket name is prepended to the endpoint's host.
+func (p *endpointPool) record(host string, ok bool) {
+	host = strings.ToLower(host)
+	for _, e := range p.endpoints {
+		if host == e.host || strings.HasSuffix(host, "."+e.host) {
+			e.record(ok)
+			return
+		}
+	}
+}
+
+func (e *poolEndpoint) record(ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ok {
+		e.failures = 0
+		return
+	}
+	e.failures++
+	if e.failures == endpointMaxFailures {
+		e.downUntil = time.Now().Add(endpointCooldown)
+		e.failures = 0
+		slog.Warn("Endpoint keeps failing, leaving it out for a while", "endpoint", e.url, "cooldown", endpointCooldown)
+	}
+}
+
+// endpointHealthClient reports the outcome of each request to the pool.
+// Requests that get no answer, or a gateway error, count against the
+// endpoint; throttling doesn't, since it comes from the cluster as a whole.
+type endpointHealthClient struct {
+	aws.HTTPClient
+	pool *endpointPool
+}
+
+func (c *endpointHealthClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.HTTPClient.Do(req)
+	ok := err == nil
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+			ok = false
+		}
+	}
+	c.pool.record(req.URL.Host, ok)
+	return resp, err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// Exit codes, so wrappers and cron jobs can tell how a run ended. Any other
+// error exits with 1.
+const (
+	// exitFailedDeletes is the exit code when the purge finished but some
+	// objects couldn't be deleted.
+	exitFailedDeletes = 2
+	// exitTooManyErrors is the exit code when --maxErrors or --maxErrorRate
+	// aborted the purge.
+	exitTooManyErrors = 3
+	// exitInterrupted is the exit code when a signal, --deadline or --runFor
+	// stopped the purge before it finished, so it can be carried on with
+	// --resume.
+	exitInterrupted = 4
+	// exitConfig is the exit code for invalid flags, rejected credentials and
+	// anything else that stopped the purge before it started deleting.
+	exitConfig = 5
+)
+
+// configError is an error that stopped the purge before it started
+// deleting.
+type configError struct{ error }
+
+func (e configError) Unwrap() error { return e.error }
+
+// thresholdError aborts the purge once --maxErrors or --maxErrorRate is
+// reached.
+type thresholdError struct{ error }
+
+func (e thresholdError) Unwrap() error { return e.error }
+
+// credentialErrorCodes are the error codes of requests whose credentials
+// were rejected, which every later request would get too.
+var credentialErrorCodes = map[string]bool{
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+	"InvalidToken":          true,
+	"TokenRefreshRequired":  true,
+}
+
+// exitCode returns the exit code for an error the purge ended with.
+func exitCode(err error) int {
+	var signing *v4.SigningError
+	switch {
+	case errors.As(err, new(configError)), errors.As(err, &signing), credentialErrorCodes[errorCode(err)]:
+		return exitConfig
+	case errors.As(err, new(thresholdError)):
+		return exitTooManyErrors
+	case errors.Is(err, errInterrupted), errors.Is(err, errDeadline):
+		return exitInterrupted
+	}
+	return 1
+}
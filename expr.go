@@ -0,0 +1,620 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// filterExpr is a compiled --filterExpr expression. The language is a small,
+// statically typed subset of CEL:
+//
+//	size > 1MB && key.startsWith("tmp/") && age > 7d
+//
+// Variables are key, etag and storageClass (strings), size (bytes),
+// lastModified (a timestamp) and age (time since lastModified). Literals are
+// numbers, "strings", sizes with a byte unit (10MB, 1GiB), durations (90s,
+// 12h, 7d) and true/false. Operators are || && ! == != < <= > >= + - and
+// parentheses; strings have startsWith, endsWith, contains, matches and
+// lower methods, and timestamp("2023-01-01") builds a timestamp.
+type filterExpr struct {
+	root exprNode
+
+	// Whether the expression uses anything other than the key, and so can't
+	// be evaluated for keys read from a file
+	usesListing bool
+}
+
+type exprType int
+
+const (
+	exprBool exprType = iota
+	exprNumber
+	exprString
+	exprDuration
+	exprTime
+)
+
+func (t exprType) String() string {
+	return [...]string{"bool", "number", "string", "duration", "timestamp"}[t]
+}
+
+// exprEnv is the object an expression is evaluated against.
+type exprEnv struct {
+	obj object
+	now time.Time
+}
+
+// exprNode is a type-checked expression tree node. eval returns a bool,
+// float64, string, time.Duration or time.Time according to typ.
+type exprNode struct {
+	typ  exprType
+	eval func(env *exprEnv) any
+
+	// Constant nodes don't depend on the object and can be evaluated up front
+	constant bool
+}
+
+// compileFilterExpr parses and type checks an expression, which must be
+// boolean.
+func compileFilterExpr(src string) (*filterExpr, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	if root.typ != exprBool {
+		return nil, fmt.Errorf("expression must be a bool, not a %s", root.typ)
+	}
+	return &filterExpr{root: root, usesListing: p.usesListing}, nil
+}
+
+// match evaluates the expression for an object.
+func (e *filterExpr) match(obj object, now time.Time) bool {
+	return e.root.eval(&exprEnv{obj: obj, now: now}).(bool)
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokSize
+	tokDuration
+	tokOp
+)
+
+type exprToken struct {
+	kind tokKind
+	text string
+	pos  int
+
+	num float64
+	str string
+	dur time.Duration
+}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	for i := 0; i < len(src); {
+		ch := rune(src[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case unicode.IsLetter(ch) || ch == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			toks = append(toks, exprToken{kind: tokIdent, text: src[i:j], pos: i})
+			i = j
+		case unicode.IsDigit(ch):
+			// A number optionally followed by a size or duration unit, so
+			// consume the whole alphanumeric run (e.g. 1h30m, 1.5GiB)
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			tok, err := lexNumber(src[i:j], i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, tok)
+			i = j
+		case ch == '"' || ch == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != src[i]; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+					switch src[j] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(src[j])
+					}
+					continue
+				}
+				sb.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			toks = append(toks, exprToken{kind: tokString, text: src[i : j+1], pos: i, str: sb.String()})
+			i = j + 1
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "(", ")", ".", ","} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", ch, i)
+			}
+			toks = append(toks, exprToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, exprToken{kind: tokEOF, text: "end of expression", pos: len(src)}), nil
+}
+
+func lexNumber(text string, pos int) (exprToken, error) {
+	tok := exprToken{text: text, pos: pos}
+	if n, err := strconv.ParseFloat(text, 64); err == nil {
+		tok.kind, tok.num = tokNumber, n
+		return tok, nil
+	}
+	if d, err := parseDuration(text); err == nil {
+		tok.kind, tok.dur = tokDuration, d
+		return tok, nil
+	}
+	if n, err := parseSize(text); err == nil {
+		tok.kind, tok.num = tokSize, float64(n)
+		return tok, nil
+	}
+	return tok, fmt.Errorf("invalid number %q at offset %d", text, pos)
+}
+
+type exprParser struct {
+	toks        []exprToken
+	pos         int
+	usesListing bool
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) acceptOp(op string) bool {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expectOp(op string) error {
+	if !p.acceptOp(op) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at offset %d, found %q", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	lhs, err := p.parseAnd()
+	if err != nil {
+		return exprNode{}, err
+	}
+	for p.acceptOp("||") {
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return exprNode{}, err
+		}
+		if lhs.typ != exprBool || rhs.typ != exprBool {
+			return exprNode{}, fmt.Errorf("|| requires bool operands, not %s and %s", lhs.typ, rhs.typ)
+		}
+		l, r := lhs.eval, rhs.eval
+		lhs = exprNode{typ: exprBool, eval: func(env *exprEnv) any {
+			return l(env).(bool) || r(env).(bool)
+		}}
+	}
+	return lhs, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	lhs, err := p.parseComparison()
+	if err != nil {
+		return exprNode{}, err
+	}
+	for p.acceptOp("&&") {
+		rhs, err := p.parseComparison()
+		if err != nil {
+			return exprNode{}, err
+		}
+		if lhs.typ != exprBool || rhs.typ != exprBool {
+			return exprNode{}, fmt.Errorf("&& requires bool operands, not %s and %s", lhs.typ, rhs.typ)
+		}
+		l, r := lhs.eval, rhs.eval
+		lhs = exprNode{typ: exprBool, eval: func(env *exprEnv) any {
+			return l(env).(bool) && r(env).(bool)
+		}}
+	}
+	return lhs, nil
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	lhs, err := p.parseAdditive()
+	if err != nil {
+		return exprNode{}, err
+	}
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return lhs, nil
+	}
+	switch tok.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return lhs, nil
+	}
+	p.next()
+	rhs, err := p.parseAdditive()
+	if err != nil {
+		return exprNode{}, err
+	}
+	if lhs.typ != rhs.typ {
+		return exprNode{}, fmt.Errorf("can't compare %s with %s at offset %d", lhs.typ, rhs.typ, tok.pos)
+	}
+	if lhs.typ == exprBool && tok.text != "==" && tok.text != "!=" {
+		return exprNode{}, fmt.Errorf("bools only support == and != at offset %d", tok.pos)
+	}
+
+	l, r, op := lhs.eval, rhs.eval, tok.text
+	return exprNode{typ: exprBool, eval: func(env *exprEnv) any {
+		c := compareValues(l(env), r(env))
+		switch op {
+		case "==":
+			return c == 0
+		case "!=":
+			return c != 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		default:
+			return c >= 0
+		}
+	}}, nil
+}
+
+// compareValues orders two values of the same type, returning -1, 0 or 1.
+func compareValues(a, b any) int {
+	switch a := a.(type) {
+	case bool:
+		if a == b.(bool) {
+			return 0
+		}
+		return 1
+	case float64:
+		return cmpOrdered(a, b.(float64))
+	case string:
+		return strings.Compare(a, b.(string))
+	case time.Duration:
+		return cmpOrdered(a, b.(time.Duration))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	}
+	panic(fmt.Sprintf("uncomparable value %T", a))
+}
+
+func cmpOrdered[T float64 | time.Duration](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (p *exprParser) parseAdditive() (exprNode, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return exprNode{}, err
+	}
+	for {
+		tok := p.peek()
+		if tok.kind != tokOp || (tok.text != "+" && tok.text != "-") {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return exprNode{}, err
+		}
+		l, r, sub := lhs.eval, rhs.eval, tok.text == "-"
+		switch {
+		case lhs.typ == exprNumber && rhs.typ == exprNumber:
+			lhs = exprNode{typ: exprNumber, eval: func(env *exprEnv) any {
+				if sub {
+					return l(env).(float64) - r(env).(float64)
+				}
+				return l(env).(float64) + r(env).(float64)
+			}}
+		case lhs.typ == exprDuration && rhs.typ == exprDuration:
+			lhs = exprNode{typ: exprDuration, eval: func(env *exprEnv) any {
+				if sub {
+					return l(env).(time.Duration) - r(env).(time.Duration)
+				}
+				return l(env).(time.Duration) + r(env).(time.Duration)
+			}}
+		case lhs.typ == exprTime && rhs.typ == exprDuration:
+			lhs = exprNode{typ: exprTime, eval: func(env *exprEnv) any {
+				d := r(env).(time.Duration)
+				if sub {
+					d = -d
+				}
+				return l(env).(time.Time).Add(d)
+			}}
+		case lhs.typ == exprString && rhs.typ == exprString && !sub:
+			lhs = exprNode{typ: exprString, constant: lhs.constant && rhs.constant, eval: func(env *exprEnv) any {
+				return l(env).(string) + r(env).(string)
+			}}
+		default:
+			return exprNode{}, fmt.Errorf("invalid operands for %s: %s and %s at offset %d", tok.text, lhs.typ, rhs.typ, tok.pos)
+		}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	tok := p.peek()
+	if tok.kind == tokOp && (tok.text == "!" || tok.text == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return exprNode{}, err
+		}
+		inner := operand.eval
+		switch {
+		case tok.text == "!" && operand.typ == exprBool:
+			return exprNode{typ: exprBool, eval: func(env *exprEnv) any { return !inner(env).(bool) }}, nil
+		case tok.text == "-" && operand.typ == exprNumber:
+			return exprNode{typ: exprNumber, eval: func(env *exprEnv) any { return -inner(env).(float64) }}, nil
+		case tok.text == "-" && operand.typ == exprDuration:
+			return exprNode{typ: exprDuration, eval: func(env *exprEnv) any { return -inner(env).(time.Duration) }}, nil
+		}
+		return exprNode{}, fmt.Errorf("invalid operand for %s: %s at offset %d", tok.text, operand.typ, tok.pos)
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return exprNode{}, err
+	}
+	for p.acceptOp(".") {
+		name := p.next()
+		if name.kind != tokIdent {
+			return exprNode{}, fmt.Errorf("expected method name at offset %d", name.pos)
+		}
+		args, err := p.parseArgs()
+		if err != nil {
+			return exprNode{}, err
+		}
+		node, err = p.method(node, name, args)
+		if err != nil {
+			return exprNode{}, err
+		}
+	}
+	return node, nil
+}
+
+func (p *exprParser) parseArgs() ([]exprNode, error) {
+	if err := p.expectOp("("); err != nil {
+		return nil, err
+	}
+	var args []exprNode
+	if p.acceptOp(")") {
+		return args, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.acceptOp(")") {
+			return args, nil
+		}
+		if err := p.expectOp(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) method(recv exprNode, name exprToken, args []exprNode) (exprNode, error) {
+	if recv.typ != exprString {
+		return exprNode{}, fmt.Errorf("%s has no method %s at offset %d", recv.typ, name.text, name.pos)
+	}
+	s := recv.eval
+
+	if name.text == "lower" {
+		if len(args) != 0 {
+			return exprNode{}, fmt.Errorf("lower takes no arguments at offset %d", name.pos)
+		}
+		return exprNode{typ: exprString, constant: recv.constant, eval: func(env *exprEnv) any {
+			return strings.ToLower(s(env).(string))
+		}}, nil
+	}
+
+	if len(args) != 1 || args[0].typ != exprString {
+		return exprNode{}, fmt.Errorf("%s takes a single string argument at offset %d", name.text, name.pos)
+	}
+	arg := args[0].eval
+
+	var fn func(a, b string) bool
+	switch name.text {
+	case "startsWith":
+		fn = strings.HasPrefix
+	case "endsWith":
+		fn = strings.HasSuffix
+	case "contains":
+		fn = strings.Contains
+	case "matches":
+		// The pattern is compiled once up front, so it has to be constant
+		// and errors surface at startup
+		pattern, ok := constString(args[0])
+		if !ok {
+			return exprNode{}, fmt.Errorf("matches requires a constant pattern at offset %d", name.pos)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return exprNode{}, fmt.Errorf("invalid regex %q at offset %d: %w", pattern, name.pos, err)
+		}
+		return exprNode{typ: exprBool, eval: func(env *exprEnv) any {
+			return re.MatchString(s(env).(string))
+		}}, nil
+	default:
+		return exprNode{}, fmt.Errorf("unknown method %s at offset %d", name.text, name.pos)
+	}
+	return exprNode{typ: exprBool, eval: func(env *exprEnv) any {
+		return fn(s(env).(string), arg(env).(string))
+	}}, nil
+}
+
+// constString returns the value of a constant string node.
+func constString(n exprNode) (string, bool) {
+	if !n.constant || n.typ != exprString {
+		return "", false
+	}
+	return n.eval(nil).(string), true
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber, tokSize:
+		n := tok.num
+		return exprNode{typ: exprNumber, eval: func(*exprEnv) any { return n }}, nil
+	case tokString:
+		s := tok.str
+		return exprNode{typ: exprString, constant: true, eval: func(*exprEnv) any { return s }}, nil
+	case tokDuration:
+		d := tok.dur
+		return exprNode{typ: exprDuration, eval: func(*exprEnv) any { return d }}, nil
+	case tokIdent:
+		if p.peek().kind == tokOp && p.peek().text == "(" {
+			return p.function(tok)
+		}
+		return p.variable(tok)
+	case tokOp:
+		if tok.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return exprNode{}, err
+			}
+			return node, p.expectOp(")")
+		}
+	}
+	return exprNode{}, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
+
+func (p *exprParser) variable(tok exprToken) (exprNode, error) {
+	switch tok.text {
+	case "true", "false":
+		b := tok.text == "true"
+		return exprNode{typ: exprBool, eval: func(*exprEnv) any { return b }}, nil
+	case "key":
+		return exprNode{typ: exprString, eval: func(env *exprEnv) any {
+			return aws.ToString(env.obj.Key)
+		}}, nil
+	}
+
+	p.usesListing = true
+	switch tok.text {
+	case "size":
+		return exprNode{typ: exprNumber, eval: func(env *exprEnv) any {
+			return float64(env.obj.Size)
+		}}, nil
+	case "lastModified":
+		return exprNode{typ: exprTime, eval: func(env *exprEnv) any {
+			return aws.ToTime(env.obj.LastModified)
+		}}, nil
+	case "age":
+		return exprNode{typ: exprDuration, eval: func(env *exprEnv) any {
+			return env.now.Sub(aws.ToTime(env.obj.LastModified))
+		}}, nil
+	case "storageClass":
+		return exprNode{typ: exprString, eval: func(env *exprEnv) any {
+			if env.obj.StorageClass == "" {
+				return string(types.ObjectStorageClassStandard)
+			}
+			return string(env.obj.StorageClass)
+		}}, nil
+	case "etag":
+		return exprNode{typ: exprString, eval: func(env *exprEnv) any {
+			return strings.Trim(aws.ToString(env.obj.ETag), `"`)
+		}}, nil
+	}
+	return exprNode{}, fmt.Errorf("unknown variable %s at offset %d", tok.text, tok.pos)
+}
+
+func (p *exprParser) function(name exprToken) (exprNode, error) {
+	args, err := p.parseArgs()
+	if err != nil {
+		return exprNode{}, err
+	}
+	if len(args) != 1 || args[0].typ != exprString {
+		return exprNode{}, fmt.Errorf("%s takes a single string argument at offset %d", name.text, name.pos)
+	}
+	s, ok := constString(args[0])
+	if !ok {
+		return exprNode{}, fmt.Errorf("%s requires a constant argument at offset %d", name.text, name.pos)
+	}
+
+	switch name.text {
+	case "timestamp":
+		t, err := parseTime(s)
+		if err != nil {
+			return exprNode{}, err
+		}
+		return exprNode{typ: exprTime, eval: func(*exprEnv) any { return t }}, nil
+	case "duration":
+		d, err := parseDuration(s)
+		if err != nil {
+			return exprNode{}, err
+		}
+		return exprNode{typ: exprDuration, eval: func(*exprEnv) any { return d }}, nil
+	}
+	return exprNode{}, fmt.Errorf("unknown function %s at offset %d", name.text, name.pos)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go"
+)
+
+// failureReport counts the objects that couldn't be deleted, by error code,
+// so the final summary is honest about what's left behind. Objects only get
+// here once their retries are used up. With --failedOut, they're also written
+// to a CSV manifest (a dead-letter file) that --retryFrom reads.
+type failureReport struct {
+	mu    sync.Mutex
+	count uint64
+	codes map[string]uint64
+
+	f   *os.File
+	out *csv.Writer
+}
+
+// openManifest starts writing failed objects to a CSV file. With resume, an
+// existing manifest is appended to rather than replaced, since a resumed
+// listing won't come across the earlier run's failed keys again.
+func (r *failureReport) openManifest(path string, resume bool) error {
+	if !strings.EqualFold(filepath.Ext(path), ".csv") {
+		return fmt.Errorf("--failedOut must be a .csv file")
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create failed keys manifest: %w", err)
+	}
+	r.f = f
+	r.out = csv.NewWriter(f)
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		r.out.Write([]string{"key", "versionId", "code", "error"})
+	}
+	return nil
+}
+
+// record accounts for objects that failed with the given error code.
+func (r *failureReport) record(objects []object, code, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.codes == nil {
+		r.codes = make(map[string]uint64)
+	}
+	r.count += uint64(len(objects))
+	r.codes[code] += uint64(len(objects))
+	r.writeLocked(objects, code, message)
+}
+
+// recordLocked adds objects left behind by Object Lock to the manifest, so
+// they can be retried with different flags. They're counted by lockReport.
+func (r *failureReport) recordLocked(obj object) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLocked([]object{obj}, "ObjectLocked", "")
+}
+
+func (r *failureReport) writeLocked(objects []object, code, message string) {
+	if r.out == nil {
+		return
+	}
+	for _, obj := range objects {
+		r.out.Write([]string{aws.ToString(obj.Key), aws.ToString(obj.VersionId), code, message})
+	}
+	// Failures are rare, so flush straight away and keep the manifest
+	// complete even if the run crashes
+	r.out.Flush()
+}
+
+// closeManifest flushes and closes the failed keys manifest, if any.
+func (r *failureReport) closeManifest() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.out == nil {
+		return nil
+	}
+	r.out.Flush()
+	if err := r.out.Error(); err != nil {
+		return fmt.Errorf("failed to write failed keys manifest: %w", err)
+	}
+	return r.f.Close()
+}
+
+func (r *failureReport) total() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+// codeCount is the number of objects that failed with an error code.
+type codeCount struct {
+	code  string
+	count uint64
+}
+
+// byCode returns the failure counts by error code, most common first.
+func (r *failureReport) byCode() []codeCount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make([]codeCount, 0, len(r.codes))
+	for code, n := range r.codes {
+		counts = append(counts, codeCount{code: code, count: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return counts[i].code < counts[j].code
+	})
+	return counts
+}
+
+// report logs how many objects failed with each error code.
+func (r *failureReport) report() {
+	total := r.total()
+	if total == 0 {
+		return
+	}
+	for _, c := range r.byCode() {
+		slog.Warn("objects failed to delete", "code", c.code, "count", c.count)
+	}
+	slog.Warn(fmt.Sprintf("%d objects could not be deleted", total))
+}
+
+// errorCode returns the API error code of a failed request, or a generic
+// code for errors that never got a response.
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return "RequestFailed"
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/urfave/cli/v2"
+)
+
+// objectFilter decides which listed objects are queued for deletion.
+// Exclusions always win over inclusions, and an empty include list matches
+// every key.
+type objectFilter struct {
+	prefix     string
+	ignoreCase bool // Applies to the prefix, globs and regexes
+
+	includes []*regexp.Regexp
+	excludes []*regexp.Regexp
+
+	// Keys that must never be deleted (--keepFrom, --ignoreFile)
+	keep   *keySet
+	ignore *ignoreRules
+
+	// Only objects with one of these normalized ETags are deleted (--etagFrom)
+	etags map[string]struct{}
+
+	// Owner IDs or display names, any of which may match (--owner)
+	owners []string
+
+	// Leave archived objects, or only those with a restore in progress, alone
+	skipArchived  bool
+	skipRestoring bool
+
+	// Compiled --filterExpr, evaluated relative to now
+	expr *filterExpr
+	now  time.Time
+
+	// Only remove delete markers, or only noncurrent versions, when purging
+	// versions
+	deleteMarkersOnly bool
+	noncurrentOnly    bool
+	// Noncurrent versions last modified before this time (--noncurrentOlderThan)
+	noncurrentBefore time.Time
+	// Objects modified after this time are never deleted (--safetyMinAge)
+	safetyCutoff time.Time
+
+	// Only delete directory markers (--directoryMarkers only)
+	markersOnly bool
+
+	// Fraction of matching keys to delete (0 disables sampling) and the
+	// seed that makes the selection reproducible
+	sample     float64
+	sampleSeed uint64
+
+	// Only objects last modified within (modifiedAfter, modifiedBefore) are
+	// deleted; a zero bound is unbounded
+	modifiedAfter  time.Time
+	modifiedBefore time.Time
+
+	// Inclusive size bounds in bytes; a negative maxSize is unbounded
+	minSize int64
+	maxSize int64
+}
+
+// newObjectFilter compiles the glob and regex patterns from the command line
+// so that bad patterns are reported before anything is deleted.
+func newObjectFilter(c *cli.Context) (*objectFilter, error) {
+	f := &objectFilter{prefix: c.String("prefix"), ignoreCase: c.Bool("ignoreCase"), maxSize: -1}
+	if f.prefix != "" && c.String("prefixesFrom") != "" {
+		return nil, fmt.Errorf("--prefix and --prefixesFrom can't be combined")
+	}
+	for _, pattern := range c.StringSlice("include") {
+		re, err := compileGlob(pattern, f.ignoreCase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+		}
+		f.includes = append(f.includes, re)
+	}
+	for _, pattern := range c.StringSlice("exclude") {
+		re, err := compileGlob(pattern, f.ignoreCase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+		f.excludes = append(f.excludes, re)
+	}
+	for _, pattern := range c.StringSlice("matchRegex") {
+		re, err := compileRegex(pattern, f.ignoreCase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match regex %q: %w", pattern, err)
+		}
+		f.includes = append(f.includes, re)
+	}
+	for _, pattern := range c.StringSlice("excludeRegex") {
+		re, err := compileRegex(pattern, f.ignoreCase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude regex %q: %w", pattern, err)
+		}
+		f.excludes = append(f.excludes, re)
+	}
+	if path := c.String("keepFrom"); path != "" {
+		keep, err := loadKeepSet(path)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("loaded keep manifest", "path", path, "keys", keep.len())
+		f.keep = keep
+	}
+	ignorePath := c.String("ignoreFile")
+	if ignorePath == "" {
+		if _, err := os.Stat(defaultIgnoreFile); err == nil {
+			ignorePath = defaultIgnoreFile
+		}
+	}
+	if ignorePath != "" {
+		ignore, err := loadIgnoreFile(ignorePath)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("loaded ignore file", "path", ignorePath, "rules", len(ignore.rules))
+		f.ignore = ignore
+	}
+
+	now := time.Now()
+	if s := c.String("olderThan"); s != "" {
+		age, err := parseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --olderThan: %w", err)
+		}
+		f.addModifiedBefore(now.Add(-age))
+	}
+	if s := c.String("newerThan"); s != "" {
+		age, err := parseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --newerThan: %w", err)
+		}
+		f.addModifiedAfter(now.Add(-age))
+	}
+	if s := c.String("noncurrentOlderThan"); s != "" {
+		age, err := parseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --noncurrentOlderThan: %w", err)
+		}
+		f.noncurrentBefore = now.Add(-age)
+	}
+	if s := c.String("safetyMinAge"); s != "" {
+		age, err := parseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --safetyMinAge: %w", err)
+		}
+		if age > 0 {
+			f.safetyCutoff = now.Add(-age)
+		}
+	}
+	if s := c.String("modifiedBefore"); s != "" {
+		t, err := parseTime(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --modifiedBefore: %w", err)
+		}
+		f.addModifiedBefore(t)
+	}
+	if s := c.String("modifiedAfter"); s != "" {
+		t, err := parseTime(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --modifiedAfter: %w", err)
+		}
+		f.addModifiedAfter(t)
+	}
+	if !f.modifiedAfter.IsZero() && !f.modifiedBefore.IsZero() && !f.modifiedAfter.Before(f.modifiedBefore) {
+		return nil, fmt.Errorf("modification time window is empty: %s is not before %s",
+			f.modifiedAfter.Format(time.RFC3339), f.modifiedBefore.Format(time.RFC3339))
+	}
+
+	if s := c.String("minSize"); s != "" {
+		size, err := parseSize(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --minSize: %w", err)
+		}
+		f.minSize = size
+	}
+	if s := c.String("maxSize"); s != "" {
+		size, err := parseSize(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --maxSize: %w", err)
+		}
+		f.maxSize = size
+	}
+	if c.Bool("zeroByteOnly") {
+		if f.minSize > 0 {
+			return nil, fmt.Errorf("--zeroByteOnly can't be combined with --minSize")
+		}
+		f.maxSize = 0
+	}
+	if f.maxSize >= 0 && f.maxSize < f.minSize {
+		return nil, fmt.Errorf("--maxSize must not be smaller than --minSize")
+	}
+
+	switch mode := c.String("directoryMarkers"); mode {
+	case "", "last":
+	case "only":
+		f.markersOnly = true
+	default:
+		return nil, fmt.Errorf("invalid --directoryMarkers %q (expected only or last)", mode)
+	}
+
+	if c.IsSet("sample") {
+		f.sample = c.Float64("sample")
+		if f.sample <= 0 || f.sample > 1 {
+			return nil, fmt.Errorf("--sample must be in the range (0, 1]")
+		}
+		if c.IsSet("seed") {
+			f.sampleSeed = uint64(c.Int64("seed"))
+		} else {
+			f.sampleSeed = rand.Uint64()
+			slog.Info("sampling with a random seed, pass --seed to reproduce this selection", "seed", int64(f.sampleSeed))
+		}
+	}
+
+	f.owners = c.StringSlice("owner")
+	f.deleteMarkersOnly = c.Bool("deleteMarkersOnly") || c.Bool("orphanMarkersOnly")
+	f.noncurrentOnly = c.Bool("noncurrentOnly")
+	f.skipArchived = c.Bool("skipArchived")
+	f.skipRestoring = c.Bool("skipRestoring")
+
+	if path := c.String("etagFrom"); path != "" {
+		etags, err := loadETags(path)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("loaded ETag allowlist", "path", path, "etags", len(etags))
+		f.etags = etags
+	}
+
+	if src := c.String("filterExpr"); src != "" {
+		expr, err := compileFilterExpr(src)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --filterExpr: %w", err)
+		}
+		f.expr = expr
+		f.now = now
+	}
+
+	// Key files carry no listing metadata to filter on
+	if c.String("keysFrom") != "" && f.needsListing() {
+		return nil, fmt.Errorf("age and size filters (including --filterExpr variables other than key) can't be used with --keysFrom")
+	}
+	return f, nil
+}
+
+// addModifiedBefore narrows the upper bound of the modification window.
+func (f *objectFilter) addModifiedBefore(t time.Time) {
+	if f.modifiedBefore.IsZero() || t.Before(f.modifiedBefore) {
+		f.modifiedBefore = t
+	}
+}
+
+// addModifiedAfter narrows the lower bound of the modification window.
+func (f *objectFilter) addModifiedAfter(t time.Time) {
+	if f.modifiedAfter.IsZero() || t.After(f.modifiedAfter) {
+		f.modifiedAfter = t
+	}
+}
+
+// needsListing reports whether any filter relies on listing metadata.
+func (f *objectFilter) needsListing() bool {
+	return !f.modifiedAfter.IsZero() || !f.modifiedBefore.IsZero() || f.minSize > 0 || f.maxSize >= 0 ||
+		len(f.owners) > 0 || f.etags != nil || f.skipArchived || f.skipRestoring ||
+		(f.expr != nil && f.expr.usesListing)
+}
+
+// match reports whether the object should be deleted. keyOnly objects carry
+// no listing metadata, so only key-based filters are applied to them.
+func (f *objectFilter) match(obj object, keyOnly bool) bool {
+	if !keyOnly && !f.matchListing(obj) {
+		return false
+	}
+	if !f.matchKey(aws.ToString(obj.Key)) {
+		return false
+	}
+	if f.expr != nil && !f.expr.match(obj, f.now) {
+		return false
+	}
+	// Sample last so the fraction applies to otherwise matching objects
+	if f.sample > 0 && !f.sampled(aws.ToString(obj.Key)) {
+		return false
+	}
+	return true
+}
+
+// matchListing applies the filters on listing metadata (size, age, owner,
+// ETag).
+func (f *objectFilter) matchListing(obj object) bool {
+	if f.deleteMarkersOnly && !obj.DeleteMarker {
+		return false
+	}
+	if f.noncurrentOnly && obj.IsLatest {
+		return false
+	}
+	if !f.noncurrentBefore.IsZero() && (obj.IsLatest || !aws.ToTime(obj.LastModified).Before(f.noncurrentBefore)) {
+		return false
+	}
+	if obj.Size < f.minSize || (f.maxSize >= 0 && obj.Size > f.maxSize) {
+		return false
+	}
+	if f.markersOnly && obj.Size != 0 {
+		return false
+	}
+
+	if !f.inTimeWindow(aws.ToTime(obj.LastModified)) {
+		return false
+	}
+	if len(f.owners) > 0 && !matchOwner(f.owners, obj.Owner) {
+		return false
+	}
+	if f.etags != nil {
+		if _, ok := f.etags[normalizeETag(aws.ToString(obj.ETag))]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// inTimeWindow reports whether t falls within the window set by the age and
+// modification time filters.
+func (f *objectFilter) inTimeWindow(t time.Time) bool {
+	if !f.modifiedBefore.IsZero() && !t.Before(f.modifiedBefore) {
+		return false
+	}
+	if !f.modifiedAfter.IsZero() && !t.After(f.modifiedAfter) {
+		return false
+	}
+	return true
+}
+
+// archiveState classifies an object that must be left alone because it is
+// archived (--skipArchived) or being restored (--skipRestoring), returning ""
+// if it may be deleted.
+func (f *objectFilter) archiveState(obj object) string {
+	if f.skipRestoring && obj.RestoreStatus != nil && obj.RestoreStatus.IsRestoreInProgress {
+		return "restoring"
+	}
+	if f.skipArchived && isArchived(obj.StorageClass) {
+		return "archived"
+	}
+	return ""
+}
+
+// tooRecent reports whether a listed object was modified too recently to be
+// deleted safely (--safetyMinAge), since the bucket may not be as idle as
+// assumed. Delete markers hold no data and are exempt.
+func (f *objectFilter) tooRecent(obj object) bool {
+	return !f.safetyCutoff.IsZero() && !obj.DeleteMarker && aws.ToTime(obj.LastModified).After(f.safetyCutoff)
+}
+
+// isArchived reports whether the storage class requires a restore before the
+// object can be read.
+func isArchived(class types.ObjectStorageClass) bool {
+	return class == types.ObjectStorageClassGlacier || class == types.ObjectStorageClassDeepArchive
+}
+
+// matchOwner reports whether the owner's ID or display name is listed.
+func matchOwner(owners []string, owner *types.Owner) bool {
+	if owner == nil {
+		return false
+	}
+	for _, want := range owners {
+		if want == aws.ToString(owner.ID) || want == aws.ToString(owner.DisplayName) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchKey applies only the key-based filters.
+func (f *objectFilter) matchKey(key string) bool {
+	if !hasPrefix(key, f.prefix, f.ignoreCase) {
+		return false
+	}
+	if f.markersOnly && !strings.HasSuffix(key, "/") {
+		return false
+	}
+	if f.keep != nil && f.keep.contains(normalizeManifestKey(key)) {
+		return false
+	}
+	if f.ignore != nil && f.ignore.ignored(key) {
+		return false
+	}
+	for _, re := range f.excludes {
+		if re.MatchString(key) {
+			return false
+		}
+	}
+	return len(f.includes) == 0 || matchAny(f.includes, key)
+}
+
+// isDirectoryMarker reports whether the object is a zero-byte "folder"
+// placeholder such as the ones created by many S3 consoles. Objects from key
+// files have no size, so only their key is considered.
+func isDirectoryMarker(obj object, keyOnly bool) bool {
+	return strings.HasSuffix(aws.ToString(obj.Key), "/") && (keyOnly || obj.Size == 0)
+}
+
+func matchAny(res []*regexp.Regexp, key string) bool {
+	for _, re := range res {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled deterministically selects a key for deletion with probability
+// f.sample. Hashing the key with the seed, rather than drawing from an RNG,
+// keeps the selection independent of listing order and concurrency.
+func (f *objectFilter) sampled(key string) bool {
+	h := fnv.New64a()
+	var seed [8]byte
+	binary.LittleEndian.PutUint64(seed[:], f.sampleSeed)
+	h.Write(seed[:])
+	h.Write([]byte(key))
+	return float64(h.Sum64()>>11)/(1<<53) < f.sample
+}
+
+// hasPrefix is strings.HasPrefix, optionally ignoring case.
+func hasPrefix(s, prefix string, ignoreCase bool) bool {
+	if ignoreCase {
+		return strings.HasPrefix(strings.ToLower(s), strings.ToLower(prefix))
+	}
+	return strings.HasPrefix(s, prefix)
+}
+
+// caseInsensitiveListPrefix returns the part of a prefix that can be sent to
+// the server when matching case-insensitively: everything before the first
+// cased character. The rest must be checked client-side.
+func caseInsensitiveListPrefix(prefix string) string {
+	for i, r := range prefix {
+		if unicode.ToLower(r) != unicode.ToUpper(r) {
+			return prefix[:i]
+		}
+	}
+	return prefix
+}
+
+func compileRegex(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// compileGlob converts a glob pattern into an anchored regular expression.
+//
+// `*` and `?` match within a single path segment, `**` matches across
+// segments and `[...]` is a character class. Patterns without a `/` match
+// the last segment of the key at any depth, so `*.tmp` matches `a/b/c.tmp`.
+func compileGlob(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	expr, err := globToRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return compileRegex("^"+expr+"$", ignoreCase)
+}
+
+// globToRegexp translates glob syntax into an unanchored regular expression.
+func globToRegexp(pattern string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch ch {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				// "**/" also matches zero segments
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					sb.WriteString("(?:.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			} else {
+				sb.WriteString(`\\`)
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return sb.String(), nil
+}
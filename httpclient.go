@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/urfave/cli/v2"
+)
+
+// newHTTPClient builds the HTTP client for the SDK from the connection
+// tuning flags. The SDK's default transport keeps only 10 idle connections
+// per host, so at high concurrency most requests would open a new
+// connection; by default the pool has room for every listing, lookup and
+// delete batch in flight instead.
+func newHTTPClient(c *cli.Context) (*awshttp.BuildableClient, error) {
+	for _, name := range []string{"requestTimeout", "connectTimeout", "tlsHandshakeTimeout", "responseHeaderTimeout"} {
+		if c.Duration(name) < 0 {
+			return nil, fmt.Errorf("--%s must not be negative", name)
+		}
+	}
+	idle := c.Int("maxIdleConnsPerHost")
+	if idle < 0 {
+		return nil, fmt.Errorf("--maxIdleConnsPerHost must not be negative")
+	}
+	if idle == 0 {
+		// Already validated at startup
+		idle, _, _ = parseConcurrency(c.String("concurrency"))
+		idle += max(0, c.Int("listConcurrency")) + max(0, c.Int("lookupConcurrency"))
+	}
+
+	return awshttp.NewBuildableClient().
+		WithTimeout(c.Duration("requestTimeout")).
+		WithDialerOptions(func(d *net.Dialer) {
+			d.Timeout = c.Duration("connectTimeout")
+		}).
+		WithTransportOptions(func(t *http.Transport) {
+			t.MaxIdleConnsPerHost = idle
+			t.MaxIdleConns = max(t.MaxIdleConns, idle)
+			t.TLSHandshakeTimeout = c.Duration("tlsHandshakeTimeout")
+			t.ResponseHeaderTimeout = c.Duration("responseHeaderTimeout")
+		}), nil
+}
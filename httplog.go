@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// httpLogMiddleware logs every attempt of an S3 request for --traceHttp,
+// with what a provider's support needs to find it: the request IDs, status
+// and latency. Headers aren't logged, since they carry the signature.
+func httpLogMiddleware(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("HTTPLog", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		start := time.Now()
+		out, metadata, err := next.HandleFinalize(ctx, in)
+
+		args := []any{"operation", awsmiddleware.GetOperationName(ctx), "latency", time.Since(start).Round(time.Microsecond)}
+		if req, ok := in.Request.(*smithyhttp.Request); ok {
+			args = append(args, "method", req.Method, "url", req.URL.String())
+		}
+		if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok && resp.Response != nil {
+			args = append(args, "status", resp.StatusCode)
+		}
+		if id, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+			args = append(args, "requestId", id)
+		}
+		if id, ok := s3.GetHostIDMetadata(metadata); ok {
+			args = append(args, "hostId", id)
+		}
+		if err != nil {
+			args = append(args, "code", errorCode(err), "error", err)
+		}
+		slog.Info("HTTP request", args...)
+		return out, metadata, err
+	}), middleware.After)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// defaultIgnoreFile is loaded from the working directory when --ignoreFile
+// isn't given.
+const defaultIgnoreFile = ".s3purgeignore"
+
+// ignoreRule is a single compiled line of an ignore file.
+type ignoreRule struct {
+	re     *regexp.Regexp
+	negate bool
+}
+
+// ignoreRules protects keys from deletion using gitignore-style syntax:
+//
+//   - blank lines and lines starting with # are skipped
+//   - a leading ! re-allows keys matched by an earlier rule
+//   - a pattern containing a / (other than a trailing one) is anchored at the
+//     bucket root, otherwise it matches at any depth
+//   - a trailing / only matches "directories", i.e. everything beneath them
+//   - a pattern matching a directory protects every key beneath it
+//
+// As in gitignore, the last matching rule wins.
+type ignoreRules struct {
+	rules []ignoreRule
+}
+
+// loadIgnoreFile reads and compiles an ignore file.
+func loadIgnoreFile(path string) (*ignoreRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ignore file: %w", err)
+	}
+	defer f.Close()
+
+	ir := &ignoreRules{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		rule, ok, err := parseIgnoreLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if ok {
+			ir.rules = append(ir.rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %w", err)
+	}
+	return ir, nil
+}
+
+func parseIgnoreLine(line string) (ignoreRule, bool, error) {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false, nil
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	dirOnly := strings.HasSuffix(line, "/")
+	line = strings.TrimSuffix(line, "/")
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignoreRule{}, false, fmt.Errorf("empty pattern")
+	}
+
+	expr, err := globToRegexp(line)
+	if err != nil {
+		return ignoreRule{}, false, err
+	}
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	if dirOnly {
+		expr += "/.*"
+	} else {
+		expr += "(?:/.*)?"
+	}
+	rule.re, err = regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return ignoreRule{}, false, err
+	}
+	return rule, true, nil
+}
+
+// ignored reports whether the key is protected from deletion.
+func (ir *ignoreRules) ignored(key string) bool {
+	ignored := false
+	for _, rule := range ir.rules {
+		if rule.re.MatchString(key) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
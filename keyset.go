@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/maphash"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// keySet is a compact set of strings for very large manifests. Only a 64-bit
+// hash of each entry is stored, so a collision can make an absent string
+// look present; callers must only use it where a false positive errs on the
+// side of not deleting.
+type keySet struct {
+	seed   maphash.Seed
+	hashes map[uint64]struct{}
+}
+
+func newKeySet() *keySet {
+	return &keySet{
+		seed:   maphash.MakeSeed(),
+		hashes: map[uint64]struct{}{},
+	}
+}
+
+func (s *keySet) add(v string) {
+	s.hashes[maphash.String(s.seed, v)] = struct{}{}
+}
+
+func (s *keySet) contains(v string) bool {
+	_, ok := s.hashes[maphash.String(s.seed, v)]
+	return ok
+}
+
+func (s *keySet) len() int {
+	return len(s.hashes)
+}
+
+// normalizeManifestKey canonicalizes a key so that manifest entries and
+// listed keys compare equal despite a leading or trailing slash.
+func normalizeManifestKey(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// loadKeepSet reads a manifest of keys to keep, one per line. Entries that
+// look URL-encoded are stored in both their raw and decoded forms, since
+// keeping a key by mistake is always preferable to deleting it.
+func loadKeepSet(path string) (*keySet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keep manifest: %w", err)
+	}
+	defer f.Close()
+
+	set := newKeySet()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		key := strings.TrimSuffix(scanner.Text(), "\r")
+		if key == "" {
+			continue
+		}
+		set.add(normalizeManifestKey(key))
+		if strings.Contains(key, "%") {
+			if decoded, err := url.PathUnescape(key); err == nil {
+				set.add(normalizeManifestKey(decoded))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read keep manifest: %w", err)
+	}
+	return set, nil
+}
+
+// normalizeETag strips the quotes S3 wraps ETags in and lowercases the hex.
+func normalizeETag(etag string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(etag), `"`))
+}
+
+// loadETags reads an allowlist of ETags, one per line. Unlike the keep set
+// this is an exact set, since a false positive here would delete an object.
+func loadETags(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ETag file: %w", err)
+	}
+	defer f.Close()
+
+	etags := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		etag := normalizeETag(scanner.Text())
+		if etag == "" {
+			continue
+		}
+		etags[etag] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ETag file: %w", err)
+	}
+	if len(etags) == 0 {
+		return nil, fmt.Errorf("ETag file %s is empty", path)
+	}
+	return etags, nil
+}
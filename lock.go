@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxLockDetails bounds how many locked objects have their retention looked
+// up and listed in the final report; the rest are only counted.
+const maxLockDetails = 1000
+
+// lockedObject is an object (or version) that couldn't be deleted because of
+// Object Lock retention or a legal hold.
+type lockedObject struct {
+	key       string
+	versionId string
+	mode      types.ObjectLockRetentionMode
+	until     time.Time
+	legalHold bool
+}
+
+// lockReport collects objects rejected by Object Lock so the run can carry
+// on and summarize them at the end.
+type lockReport struct {
+	svc        *s3.Client
+	bucketName string
+
+	mu      sync.Mutex
+	count   int
+	details []lockedObject
+}
+
+// isObjectLockError reports whether a per-key DeleteObjects error was caused
+// by retention or a legal hold rather than a general failure.
+func isObjectLockError(e types.Error) bool {
+	code := aws.ToString(e.Code)
+	msg := strings.ToLower(aws.ToString(e.Message))
+	switch code {
+	case "ObjectLocked":
+		return true
+	case "AccessDenied", "InvalidRequest":
+		return strings.Contains(msg, "object lock") || strings.Contains(msg, "retention") ||
+			strings.Contains(msg, "legal hold") || strings.Contains(msg, "worm")
+	}
+	return false
+}
+
+// record notes a locked object, looking up its retention and legal hold
+// while the report has room for details.
+func (r *lockReport) record(ctx context.Context, obj object) {
+	r.mu.Lock()
+	r.count++
+	detailed := r.count <= maxLockDetails
+	r.mu.Unlock()
+
+	slog.Debug("object is locked, skipping", "key", aws.ToString(obj.Key), "versionId", aws.ToString(obj.VersionId))
+	if !detailed {
+		return
+	}
+
+	locked := lockedObject{key: aws.ToString(obj.Key), versionId: aws.ToString(obj.VersionId)}
+	retention, err := r.svc.GetObjectRetention(ctx, &s3.GetObjectRetentionInput{
+		Bucket:    &r.bucketName,
+		Key:       obj.Key,
+		VersionId: obj.VersionId,
+	})
+	if err == nil && retention.Retention != nil {
+		locked.mode = retention.Retention.Mode
+		locked.until = aws.ToTime(retention.Retention.RetainUntilDate)
+	}
+	hold, err := r.svc.GetObjectLegalHold(ctx, &s3.GetObjectLegalHoldInput{
+		Bucket:    &r.bucketName,
+		Key:       obj.Key,
+		VersionId: obj.VersionId,
+	})
+	if err == nil && hold.LegalHold != nil {
+		locked.legalHold = hold.LegalHold.Status == types.ObjectLockLegalHoldStatusOn
+	}
+
+	r.mu.Lock()
+	r.details = append(r.details, locked)
+	r.mu.Unlock()
+}
+
+// total returns how many locked objects were recorded.
+func (r *lockReport) total() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+// report logs every locked object found during the run.
+func (r *lockReport) report() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.count == 0 {
+		return
+	}
+
+	for _, locked := range r.details {
+		args := []any{"key", locked.key}
+		if locked.versionId != "" {
+			args = append(args, "versionId", locked.versionId)
+		}
+		if locked.mode != "" {
+			args = append(args, "mode", locked.mode, "retainUntil", locked.until.Format(time.RFC3339))
+		}
+		if locked.legalHold {
+			args = append(args, "legalHold", true)
+		}
+		slog.Warn("locked object was not deleted", args...)
+	}
+	msg := fmt.Sprintf("%d objects were not deleted because of Object Lock", r.count)
+	if r.count > len(r.details) {
+		msg += fmt.Sprintf(" (details shown for the first %d)", len(r.details))
+	}
+	slog.Warn(msg)
+}
+
+// confirmRemoveLegalHolds makes the operator explicitly acknowledge that
+// legal holds will be lifted before any deletion starts.
+func confirmRemoveLegalHolds(bucketName string) error {
+	const phrase = "remove legal holds"
+	answer, err := promptTTY(fmt.Sprintf("--removeLegalHolds will lift legal holds on locked objects in %s before deleting them.\nType %q to continue: ", bucketName, phrase))
+	if err != nil {
+		return fmt.Errorf("--removeLegalHolds requires confirmation: %w", err)
+	}
+	if answer != phrase {
+		return fmt.Errorf("--removeLegalHolds was not confirmed")
+	}
+	return nil
+}
+
+// releaseLegalHold lifts the legal hold on a locked object, if it has one,
+// and deletes it again. It reports whether the object was deleted; objects
+// that are also under retention stay locked.
+func (p *purger) releaseLegalHold(ctx context.Context, obj object) bool {
+	hold, err := p.svc.GetObjectLegalHold(ctx, &s3.GetObjectLegalHoldInput{
+		Bucket:    &p.bucketName,
+		Key:       obj.Key,
+		VersionId: obj.VersionId,
+	})
+	if err != nil || hold.LegalHold == nil || hold.LegalHold.Status != types.ObjectLockLegalHoldStatusOn {
+		return false
+	}
+
+	_, err = p.svc.PutObjectLegalHold(ctx, &s3.PutObjectLegalHoldInput{
+		Bucket:    &p.bucketName,
+		Key:       obj.Key,
+		VersionId: obj.VersionId,
+		LegalHold: &types.ObjectLockLegalHold{Status: types.ObjectLockLegalHoldStatusOff},
+	})
+	if err != nil {
+		slog.Error("failed to remove legal hold", "key", aws.ToString(obj.Key), "versionId", aws.ToString(obj.VersionId), "error", err)
+		return false
+	}
+	slog.Info("removed legal hold", "key", aws.ToString(obj.Key), "versionId", aws.ToString(obj.VersionId))
+
+	input := &s3.DeleteObjectInput{
+		Bucket:                    &p.bucketName,
+		Key:                       obj.Key,
+		VersionId:                 obj.VersionId,
+		BypassGovernanceRetention: p.bypassGovernance,
+	}
+	if p.mfa != nil {
+		header, _ := p.mfa.header()
+		input.MFA = &header
+	}
+	output, err := p.svc.DeleteObject(ctx, input)
+	if err != nil {
+		slog.Debug("object still locked after removing legal hold", "key", aws.ToString(obj.Key), "error", err)
+		return false
+	}
+	p.recordAudit([]object{obj}, output.ResultMetadata)
+	return true
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/urfave/cli/v2"
+)
+
+// lookupFilter narrows candidate objects using per-object API calls that
+// can't be answered from the listing alone, such as tags or HeadObject
+// metadata.
+type lookupFilter struct {
+	svc        *s3.Client
+	bucketName string
+	// Bounds the lookups in flight across every listing
+	sem chan struct{}
+
+	// Required tags; an empty value only requires the tag to be present
+	tags map[string]string
+
+	// Accepted media types (any may match), e.g. "application/x-tar" or "image/*"
+	contentTypes []string
+	// Required user metadata, keyed by lowercase name without x-amz-meta-
+	metadata map[string]string
+	// Only objects stored without server-side encryption are deleted
+	unencryptedOnly bool
+}
+
+// newLookupFilter parses the lookup-based filters from the command line.
+func newLookupFilter(c *cli.Context, svc *s3.Client, bucketName string) (*lookupFilter, error) {
+	concurrency := c.Int("lookupConcurrency")
+	if concurrency < 1 {
+		return nil, fmt.Errorf("--lookupConcurrency must be at least 1")
+	}
+	f := &lookupFilter{
+		svc:        svc,
+		bucketName: bucketName,
+		sem:        make(chan struct{}, concurrency),
+		tags:       map[string]string{},
+		metadata:   map[string]string{},
+	}
+	for _, tag := range c.StringSlice("tag") {
+		k, v, _ := strings.Cut(tag, "=")
+		if k == "" {
+			return nil, fmt.Errorf("invalid tag filter %q (expected key=value)", tag)
+		}
+		f.tags[k] = v
+	}
+	for _, ct := range c.StringSlice("contentType") {
+		f.contentTypes = append(f.contentTypes, normalizeMediaType(ct))
+	}
+	for _, md := range c.StringSlice("metadata") {
+		k, v, _ := strings.Cut(md, "=")
+		k = strings.TrimPrefix(strings.ToLower(k), "x-amz-meta-")
+		if k == "" {
+			return nil, fmt.Errorf("invalid metadata filter %q (expected key=value)", md)
+		}
+		f.metadata[k] = v
+	}
+	f.unencryptedOnly = c.Bool("unencryptedOnly")
+	return f, nil
+}
+
+// enabled reports whether any lookups are required.
+func (f *lookupFilter) enabled() bool {
+	return len(f.tags) > 0 || f.needsHead()
+}
+
+// needsHead reports whether a HeadObject call is required per object.
+func (f *lookupFilter) needsHead() bool {
+	return len(f.contentTypes) > 0 || len(f.metadata) > 0 || f.unencryptedOnly
+}
+
+// filter runs lookups for the candidates concurrently and returns the ones
+// that match, preserving listing order. Objects whose lookups fail are kept
+// out of the deletion set and counted in the returned error total.
+func (f *lookupFilter) filter(ctx context.Context, objects []object) ([]object, int) {
+	matched := make([]bool, len(objects))
+	failed := make([]bool, len(objects))
+
+	var wg sync.WaitGroup
+	for i := range objects {
+		f.sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-f.sem
+				wg.Done()
+			}()
+			ok, err := f.matchObject(ctx, objects[i])
+			if err != nil {
+				slog.Warn("lookup failed, not deleting object", "key", aws.ToString(objects[i].Key), "error", err)
+				failed[i] = true
+				return
+			}
+			matched[i] = ok
+		}(i)
+	}
+	wg.Wait()
+
+	var out []object
+	errors := 0
+	for i := range objects {
+		if matched[i] {
+			out = append(out, objects[i])
+		}
+		if failed[i] {
+			errors++
+		}
+	}
+	return out, errors
+}
+
+// dateKeys fills in the modification time of key-only candidates, e.g. from
+// a key file, with HeadObject calls so --safetyMinAge can apply to them.
+// Keys that are already gone, or name a delete marker, have no time to fill
+// in and are kept. Objects whose lookups fail are kept out of the deletion
+// set and counted in the returned error total.
+func (f *lookupFilter) dateKeys(ctx context.Context, objects []object) ([]object, int) {
+	failed := make([]bool, len(objects))
+
+	var wg sync.WaitGroup
+	for i := range objects {
+		f.sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-f.sem
+				wg.Done()
+			}()
+			out, err := f.svc.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket:    &f.bucketName,
+				Key:       objects[i].Key,
+				VersionId: objects[i].VersionId,
+			})
+			switch {
+			case err == nil:
+				objects[i].LastModified = out.LastModified
+			case alreadyDeleted(errorCode(err)), errorCode(err) == "NotFound", errorCode(err) == "MethodNotAllowed":
+			default:
+				slog.Warn("lookup failed, not deleting object", "key", aws.ToString(objects[i].Key), "error", err)
+				failed[i] = true
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var out []object
+	errors := 0
+	for i := range objects {
+		if failed[i] {
+			errors++
+			continue
+		}
+		out = append(out, objects[i])
+	}
+	return out, errors
+}
+
+// matchObject performs the lookups for a single object.
+func (f *lookupFilter) matchObject(ctx context.Context, obj object) (bool, error) {
+	// Delete markers have no tags or metadata to match
+	if obj.DeleteMarker {
+		return false, nil
+	}
+	if len(f.tags) > 0 {
+		out, err := f.svc.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+			Bucket:    &f.bucketName,
+			Key:       obj.Key,
+			VersionId: obj.VersionId,
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to get object tagging: %w", err)
+		}
+		if !matchTags(f.tags, out.TagSet) {
+			return false, nil
+		}
+	}
+	if f.needsHead() {
+		out, err := f.svc.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:    &f.bucketName,
+			Key:       obj.Key,
+			VersionId: obj.VersionId,
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to head object: %w", err)
+		}
+		if len(f.contentTypes) > 0 && !matchContentType(f.contentTypes, aws.ToString(out.ContentType)) {
+			return false, nil
+		}
+		if !matchMetadata(f.metadata, out.Metadata) {
+			return false, nil
+		}
+		// Neither SSE-S3/SSE-KMS nor a customer-provided key (SSE-C)
+		if f.unencryptedOnly && (out.ServerSideEncryption != "" || out.SSECustomerAlgorithm != nil) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// normalizeMediaType lowercases a content type and strips any parameters.
+func normalizeMediaType(ct string) string {
+	ct, _, _ = strings.Cut(ct, ";")
+	return strings.ToLower(strings.TrimSpace(ct))
+}
+
+// matchContentType reports whether the content type matches any accepted
+// media type, where "type/*" matches every subtype.
+func matchContentType(accepted []string, contentType string) bool {
+	ct := normalizeMediaType(contentType)
+	for _, want := range accepted {
+		if want == ct {
+			return true
+		}
+		if base, ok := strings.CutSuffix(want, "/*"); ok && strings.HasPrefix(ct, base+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMetadata reports whether every required user metadata entry is present.
+func matchMetadata(required map[string]string, metadata map[string]string) bool {
+	have := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		have[strings.ToLower(k)] = v
+	}
+	for k, v := range required {
+		got, ok := have[k]
+		if !ok || (v != "" && got != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTags reports whether every required tag is present in the tag set.
+func matchTags(required map[string]string, tagSet []types.Tag) bool {
+	have := make(map[string]string, len(tagSet))
+	for _, tag := range tagSet {
+		have[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	for k, v := range required {
+		got, ok := have[k]
+		if !ok || (v != "" && got != v) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,60 +2,52 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
 	"os"
-	"sync"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
 	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/urfave/cli/v2"
 )
 
-func deleteObjects(svc *s3.Client, bucketName string, keys []string, wg *sync.WaitGroup, counter *atomic.Uint64) {
-	defer wg.Done()
-
-	_, err := svc.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
-		Bucket: &bucketName,
-		Delete: &types.Delete{
-			Objects: func() []types.ObjectIdentifier {
-				identifiers := make([]types.ObjectIdentifier, len(keys))
-				for i := range keys {
-					key := keys[i]
-					identifiers[i] = types.ObjectIdentifier{
-						Key: &key,
-					}
-				}
-				return identifiers
-			}(),
-		},
-	})
-
-	if err != nil {
-		slog.Error("failed to delete objects", "keys", keys, "error", err)
-		return
-	}
-
-	for _, key := range keys {
-		slog.Debug("deleted object", "key", key)
-	}
-	counter.Add(uint64(len(keys)))
-}
-
 func main() {
+	// Errors before the flags have been parsed and checked are usage errors
+	parsed := false
 	app := &cli.App{
 		Name:  "s3purge",
 		Usage: "Delete all files in an S3-compatible bucket",
+		Before: func(c *cli.Context) error {
+			parsed = true
+			logLvl := new(slog.LevelVar)
+			logLvl.UnmarshalText([]byte(c.String("logLevel")))
+			options := &slog.HandlerOptions{Level: logLvl}
+			switch c.String("logFormat") {
+			case "text":
+				slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+			case "json":
+				slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+			default:
+				return configError{fmt.Errorf("--logFormat must be text or json")}
+			}
+			if addr := c.String("pprofAddr"); addr != "" {
+				if err := servePprof(addr); err != nil {
+					return configError{err}
+				}
+			}
+			return nil
+		},
+		Commands: []*cli.Command{benchCommand(), countCommand()},
 		Flags: []cli.Flag{
-			&cli.StringFlag{
+			&cli.StringSliceFlag{
 				Name:     "endpoint",
-				Usage:    "S3-compatible endpoint URL",
+				Usage:    "S3-compatible endpoint URL, repeat for several gateways of the same cluster to spread requests across them",
 				Required: true,
 			},
 			&cli.StringFlag{
@@ -64,123 +56,1041 @@ func main() {
 				Required: true,
 			},
 			&cli.StringFlag{
-				Name:     "accessKey",
-				Usage:    "Access key ID",
-				Required: true,
+				Name:    "accessKey",
+				Usage:   "Access key ID, if not using --profile or the SDK's default credential chain",
+				EnvVars: []string{"S3PURGE_ACCESS_KEY"},
 			},
 			&cli.StringFlag{
-				Name:     "secretKey",
-				Usage:    "Secret access key",
-				Required: true,
+				Name:  "accessKeyFile",
+				Usage: "Read --accessKey from this file",
+			},
+			&cli.StringFlag{
+				Name:    "secretKey",
+				Usage:   "Secret access key",
+				EnvVars: []string{"S3PURGE_SECRET_KEY"},
+			},
+			&cli.StringFlag{
+				Name:  "secretKeyFile",
+				Usage: "Read --secretKey from this file, so it doesn't show up in ps or shell history",
+			},
+			&cli.StringFlag{
+				Name:    "sessionToken",
+				Usage:   "Session token of temporary credentials, e.g. from STS or an SSO console, with --accessKey and --secretKey",
+				EnvVars: []string{"S3PURGE_SESSION_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:  "sessionTokenFile",
+				Usage: "Read --sessionToken from this file",
+			},
+			&cli.StringFlag{
+				Name:  "profile",
+				Usage: "Use the credentials of this profile from the shared AWS config and credentials files instead of --accessKey and --secretKey",
+			},
+			&cli.StringFlag{
+				Name:  "credentialsFrom",
+				Usage: "Fetch the key pair from a secret store: vault:<path> for a HashiCorp Vault secret (with VAULT_ADDR and VAULT_TOKEN), or the ARN of a Secrets Manager secret",
+			},
+			&cli.BoolFlag{
+				Name:  "anonymous",
+				Usage: "Send unsigned requests, for local test servers without authentication and public-write buckets",
+			},
+			&cli.StringFlag{
+				Name:  "roleArn",
+				Usage: "Assume this IAM role, e.g. for a bucket in another account, with the other credentials",
+			},
+			&cli.StringFlag{
+				Name:  "externalId",
+				Usage: "External ID to assume --roleArn with, if its trust policy requires one",
+			},
+			&cli.StringFlag{
+				Name:  "sessionName",
+				Usage: "Session name to assume --roleArn with, as shown in CloudTrail",
+				Value: "s3purge",
+			},
+			&cli.StringFlag{
+				Name:  "webIdentityTokenFile",
+				Usage: "Assume --roleArn with the OIDC token in this file, such as a Kubernetes service account's, instead of other credentials",
+			},
+			&cli.StringFlag{
+				Name:  "stsEndpoint",
+				Usage: "STS endpoint URL to assume --roleArn at, for providers with an STS of their own (defaults to AWS's)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "protect",
+				Usage: "Refuse to operate on buckets matching this name pattern, e.g. prod-* (repeatable)",
+			},
+			&cli.StringFlag{
+				Name:  "protectFile",
+				Usage: "Refuse to operate on buckets matching any pattern in this file (default: " + defaultProtectFile + " if present)",
+			},
+			&cli.StringFlag{
+				Name:  "prefix",
+				Usage: "Only purge objects whose keys begin with this prefix",
+			},
+			&cli.StringFlag{
+				Name:  "prefixesFrom",
+				Usage: "List and purge every prefix in this file (one per line) instead of a single --prefix",
+			},
+			&cli.IntFlag{
+				Name:  "listConcurrency",
+				Usage: "Number of prefixes or key ranges listed in parallel with --prefixesFrom, --shard or --shardAlphabet",
+				Value: 4,
+			},
+			&cli.BoolFlag{
+				Name:  "shard",
+				Usage: "Split --prefix (or the whole bucket) at the next / and list the shards in parallel (--listConcurrency)",
+			},
+			&cli.StringFlag{
+				Name:  "shardAlphabet",
+				Usage: "Split --prefix into key ranges at each of these characters (e.g. 0123456789abcdef for hashed keys) and list the ranges in parallel",
+			},
+			&cli.IntFlag{
+				Name:  "shardDepth",
+				Usage: "Number of --shardAlphabet characters in each range boundary, for alphabet^depth ranges",
+				Value: 1,
+			},
+			&cli.StringSliceFlag{
+				Name:  "include",
+				Usage: "Only delete keys matching this glob pattern (repeatable)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "exclude",
+				Usage: "Never delete keys matching this glob pattern (repeatable, wins over --include)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "matchRegex",
+				Usage: "Only delete keys matching this regular expression (repeatable)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "excludeRegex",
+				Usage: "Never delete keys matching this regular expression (repeatable)",
+			},
+			&cli.BoolFlag{
+				Name:  "ignoreCase",
+				Usage: "Match --prefix, --prefixesFrom, globs and regexes case-insensitively",
+			},
+			&cli.StringFlag{
+				Name:  "olderThan",
+				Usage: "Only delete objects last modified longer ago than this duration (e.g. 720h, 30d)",
+			},
+			&cli.StringFlag{
+				Name:  "newerThan",
+				Usage: "Only delete objects last modified more recently than this duration (e.g. 12h, 2d)",
+			},
+			&cli.StringFlag{
+				Name:  "safetyMinAge",
+				Usage: "Never delete objects modified more recently than this, whatever the other filters say (0 disables)",
+				Value: "15m",
+			},
+			&cli.StringFlag{
+				Name:  "modifiedAfter",
+				Usage: "Only delete objects last modified after this time (RFC 3339 or YYYY-MM-DD)",
+			},
+			&cli.StringFlag{
+				Name:  "modifiedBefore",
+				Usage: "Only delete objects last modified before this time (RFC 3339 or YYYY-MM-DD)",
+			},
+			&cli.StringFlag{
+				Name:  "minSize",
+				Usage: "Only delete objects at least this large (e.g. 512, 10MB, 1GiB)",
+			},
+			&cli.StringFlag{
+				Name:  "maxSize",
+				Usage: "Only delete objects at most this large (e.g. 512, 10MB, 1GiB)",
+			},
+			&cli.BoolFlag{
+				Name:  "zeroByteOnly",
+				Usage: "Only delete empty (zero-byte) objects",
+			},
+			&cli.StringFlag{
+				Name:  "directoryMarkers",
+				Usage: "Directory marker handling: only (delete nothing but zero-byte keys ending in /) or last (delete them in a final pass)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "owner",
+				Usage: "Only delete objects owned by this owner ID or display name (repeatable, any may match)",
+			},
+			&cli.StringFlag{
+				Name:  "etagFrom",
+				Usage: "Only delete objects whose ETag is listed in this file (one per line)",
+			},
+			&cli.BoolFlag{
+				Name:  "skipArchived",
+				Usage: "Never delete objects in archival storage classes (GLACIER, DEEP_ARCHIVE)",
+			},
+			&cli.BoolFlag{
+				Name:  "skipRestoring",
+				Usage: "Never delete objects with a restore in progress",
+			},
+			&cli.StringFlag{
+				Name:  "filterExpr",
+				Usage: `Only delete objects matching this expression, e.g. 'size > 1MB && key.startsWith("tmp/") && age > 7d'`,
+			},
+			&cli.StringFlag{
+				Name:  "keepFrom",
+				Usage: "Delete every object except the keys listed in this file (one per line)",
+			},
+			&cli.StringFlag{
+				Name:  "ignoreFile",
+				Usage: "Never delete keys matched by this gitignore-style file (default: ./.s3purgeignore if present)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "tag",
+				Usage: "Only delete objects tagged key=value, or carrying the tag key at all (repeatable, all must match)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "contentType",
+				Usage: "Only delete objects with this Content-Type, e.g. application/x-tar or image/* (repeatable, any may match)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "metadata",
+				Usage: "Only delete objects with this user metadata key=value (repeatable, all must match)",
+			},
+			&cli.BoolFlag{
+				Name:  "unencryptedOnly",
+				Usage: "Only delete objects stored without server-side encryption",
+			},
+			&cli.IntFlag{
+				Name:  "lookupConcurrency",
+				Usage: "Number of concurrent per-object lookups used by --tag, --contentType, --metadata, --unencryptedOnly and --safetyMinAge with --keysFrom, shared by every listing",
+				Value: 50,
+			},
+			&cli.StringFlag{
+				Name:  "keysFrom",
+				Usage: "Delete the keys (or versions) listed in this file (one per line, CSV with a header, or JSONL) instead of listing the bucket; - reads from stdin",
+			},
+			&cli.StringFlag{
+				Name:  "retryFrom",
+				Usage: "Delete only the keys in a --failedOut manifest from an earlier run",
+			},
+			&cli.StringFlag{
+				Name:  "keysColumn",
+				Usage: "Column holding the key when --keysFrom is a CSV file",
+				Value: "key",
+			},
+			&cli.StringFlag{
+				Name:  "versionColumn",
+				Usage: "Column holding the version ID, if any, when --keysFrom is a CSV file",
+				Value: "versionId",
+			},
+			&cli.DurationFlag{
+				Name:  "idleFlush",
+				Usage: "Delete any partial batch once stdin has been idle this long when using --keysFrom -",
+				Value: time.Second,
+			},
+			&cli.Float64Flag{
+				Name:  "sample",
+				Usage: "Only delete this random fraction of matching objects, e.g. 0.01 for 1%",
 			},
 			&cli.Int64Flag{
-				Name:  "concurrency",
-				Usage: "Number of concurrent deletions",
-				Value: 250,
+				Name:  "seed",
+				Usage: "Seed for --sample so the same objects are selected on every run (random if unset)",
+			},
+			&cli.StringFlag{
+				Name:  "mode",
+				Usage: "Deletion mode on versioned buckets: soft (create delete markers) or permanent (delete every version)",
+			},
+			&cli.BoolFlag{
+				Name:  "allowVersioned",
+				Usage: "Allow deleting from a versioning-enabled bucket: current objects, and --keysFrom keys without a version ID, get delete markers (same as --mode soft), while listed version IDs are deleted permanently",
+			},
+			&cli.BoolFlag{
+				Name:  "allVersions",
+				Usage: "Permanently delete every object version and delete marker, not just current objects",
+			},
+			&cli.BoolFlag{
+				Name:  "deleteMarkersOnly",
+				Usage: "Only remove delete markers from a versioned bucket, restoring the objects they hide",
+			},
+			&cli.BoolFlag{
+				Name:  "orphanMarkersOnly",
+				Usage: "Only remove delete markers of keys with no versions left (expired object delete markers)",
+			},
+			&cli.BoolFlag{
+				Name:  "noncurrentOnly",
+				Usage: "Only permanently delete noncurrent versions, keeping the current version of every key",
+			},
+			&cli.StringFlag{
+				Name:  "noncurrentOlderThan",
+				Usage: "Only permanently delete noncurrent versions last modified longer ago than this duration (e.g. 30d)",
+			},
+			&cli.IntFlag{
+				Name:  "keepVersions",
+				Usage: "Permanently delete all but the newest N versions (including delete markers) of each key",
+			},
+			&cli.StringFlag{
+				Name:  "mfaSerial",
+				Usage: "Serial number or ARN of the MFA device, for buckets with MFA Delete enabled",
+			},
+			&cli.StringFlag{
+				Name:  "mfaToken",
+				Usage: "Current MFA code for --mfaSerial (prompted for if omitted, and again whenever it expires)",
+			},
+			&cli.BoolFlag{
+				Name:  "bypassGovernance",
+				Usage: "Bypass governance-mode Object Lock retention (requires s3:BypassGovernanceRetention)",
+			},
+			&cli.BoolFlag{
+				Name:  "removeLegalHolds",
+				Usage: "Lift legal holds on locked objects and retry deleting them (asks for confirmation)",
+			},
+			&cli.BoolFlag{
+				Name:  "suspendVersioning",
+				Usage: "Suspend bucket versioning during the purge and re-enable it afterwards, even if interrupted",
+			},
+			&cli.BoolFlag{
+				Name:  "abortMultipart",
+				Usage: "Also abort incomplete multipart uploads whose keys match the key filters and that were initiated within the age filters",
+			},
+			&cli.BoolFlag{
+				Name:  "multipartOnly",
+				Usage: "Only abort incomplete multipart uploads, leaving objects alone",
+			},
+			&cli.BoolFlag{
+				Name:  "deleteBucket",
+				Usage: "Delete the bucket itself once every version and multipart upload is gone",
+			},
+			&cli.BoolFlag{
+				Name:  "summary",
+				Usage: "Before deleting, list once and print a du-style breakdown of what would be deleted by top-level prefix",
+			},
+			&cli.StringFlag{
+				Name:  "summaryOut",
+				Usage: "Write a JSON summary of the run (counts, failures by error code, duration, rate and flags) to this file at exit",
+			},
+			&cli.StringFlag{
+				Name:  "notifyUrl",
+				Usage: "POST a JSON summary to this webhook (e.g. a Slack incoming webhook) when the run finishes, fails or is aborted",
+			},
+			&cli.IntFlag{
+				Name:  "prefixStats",
+				Usage: "Break deletions down by prefix, this many path segments below --prefix, in the progress log and final summary (0 is off)",
+			},
+			&cli.BoolFlag{
+				Name:  "dryRun",
+				Usage: "List and filter as usual, but only report what would be deleted",
+			},
+			&cli.StringFlag{
+				Name:  "manifestOut",
+				Usage: "With --dryRun, write every object that would be deleted to this file (CSV, or JSONL if it ends in .jsonl)",
+			},
+			&cli.BoolFlag{
+				Name:  "yes",
+				Usage: "Don't ask for the bucket name (or any other confirmation) before deleting",
+			},
+			&cli.StringFlag{
+				Name:  "planOut",
+				Usage: "Write a reviewable plan of everything that would be deleted to this file instead of deleting it",
+			},
+			&cli.StringFlag{
+				Name:  "applyPlan",
+				Usage: "Delete exactly the objects in this plan file, refusing if the bucket has drifted too far from it",
+			},
+			&cli.StringFlag{
+				Name:  "planHash",
+				Usage: "Approved snapshot hash that the --applyPlan plan must match (required with --applyPlan)",
+			},
+			&cli.Float64Flag{
+				Name:  "maxDrift",
+				Usage: "Largest fraction of planned objects that may have changed or disappeared for --applyPlan to proceed",
+				Value: 0.01,
+			},
+			&cli.StringFlag{
+				Name:  "checkpoint",
+				Usage: "Periodically save listing progress to this file, so an interrupted purge can be continued with --resume",
+			},
+			&cli.DurationFlag{
+				Name:  "checkpointInterval",
+				Usage: "How often to save the --checkpoint file",
+				Value: time.Minute,
+			},
+			&cli.BoolFlag{
+				Name:  "resume",
+				Usage: "Continue the purge from the position saved in the --checkpoint file",
+			},
+			&cli.IntFlag{
+				Name:  "canary",
+				Usage: "Delete the first N matching objects on their own and ask before continuing at full concurrency",
+			},
+			&cli.DurationFlag{
+				Name:  "canaryDelay",
+				Usage: "Continue this long after the --canary batch instead of asking",
+			},
+			&cli.Uint64Flag{
+				Name:  "maxDelete",
+				Usage: "Safety limit: abort the run if more than this many objects match (0 is unlimited)",
+			},
+			&cli.StringFlag{
+				Name:  "failedOut",
+				Usage: "Write every object that couldn't be deleted, with its error code, to this CSV file",
+			},
+			&cli.StringFlag{
+				Name:  "auditLog",
+				Usage: "Append a hash-chained record of every deleted object, with the ID of the request that deleted it, to this CSV (or .jsonl) file",
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Usage: "Number of times keys failing with a retryable error (e.g. SlowDown, InternalError) are retried",
+				Value: 3,
+			},
+			&cli.DurationFlag{
+				Name:  "retryBackoff",
+				Usage: "Delay before the first retry of failed keys, doubling (with jitter) on each further retry",
+				Value: time.Second,
+			},
+			&cli.IntFlag{
+				Name:  "listRetries",
+				Usage: "Number of times a listing page failing with a retryable error is retried, backing off like --retryBackoff",
+				Value: 5,
+			},
+			&cli.StringFlag{
+				Name:  "signatureVersion",
+				Usage: "Request signing: v4, or v2 for old Ceph RGW clusters and appliances that only accept Signature Version 2",
+				Value: "v4",
+			},
+			&cli.StringFlag{
+				Name:  "sdkRetryMode",
+				Usage: "AWS SDK retry mode for each request: standard, or adaptive (client-side rate limiting on throttling)",
+				Value: "standard",
+			},
+			&cli.IntFlag{
+				Name:  "sdkMaxAttempts",
+				Usage: "Maximum attempts the AWS SDK makes for each request (0 keeps the SDK default of 3)",
+			},
+			&cli.DurationFlag{
+				Name:  "sdkMaxBackoff",
+				Usage: "Maximum delay between AWS SDK attempts (0 keeps the SDK default of 20s)",
+			},
+			&cli.Uint64Flag{
+				Name:  "maxErrors",
+				Usage: "Abort the run once this many batches have failed (0 is unlimited)",
+			},
+			&cli.Float64Flag{
+				Name:  "maxErrorRate",
+				Usage: "Abort the run once more than this fraction of batches have failed, e.g. 0.1 (0 is unlimited)",
+			},
+			&cli.Uint64Flag{
+				Name:  "maxObjects",
+				Usage: "Stop after this many objects have been queued for deletion (0 is unlimited)",
+			},
+			&cli.Uint64Flag{
+				Name:  "head",
+				Usage: "Preview run: delete only the first N matching keys, logging each one, then stop",
+			},
+			&cli.StringFlag{
+				Name:    "concurrency",
+				Aliases: []string{"deleteConcurrency"},
+				Usage:   "Number of delete batches in flight, or auto to tune it to the provider",
+				Value:   "250",
+			},
+			&cli.StringFlag{
+				Name:  "maxMemory",
+				Usage: "Rough memory budget (e.g. 512MiB), lowering --concurrency to fit and making the garbage collector work harder near it",
+			},
+			&cli.IntFlag{
+				Name:  "batchSize",
+				Usage: "Objects per DeleteObjects request, up to 1000 (default 1000 for AWS and Cloudflare R2 endpoints, otherwise 500)",
+			},
+			&cli.Float64Flag{
+				Name:  "maxRate",
+				Usage: "Delete at most this many objects per second (0 is unlimited)",
+			},
+			&cli.Float64Flag{
+				Name:  "maxRps",
+				Usage: "Make at most this many API requests per second, of any kind (0 is unlimited)",
+			},
+			&cli.DurationFlag{
+				Name:  "requestTimeout",
+				Usage: "Give up on any single S3 request that takes longer than this (0 is no limit)",
+			},
+			&cli.IntFlag{
+				Name:  "maxIdleConnsPerHost",
+				Usage: "Idle HTTP connections to keep open for reuse (default is the sum of the list, lookup and delete concurrencies)",
+			},
+			&cli.DurationFlag{
+				Name:  "connectTimeout",
+				Usage: "Timeout for establishing a TCP connection",
+				Value: 30 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "tlsHandshakeTimeout",
+				Usage: "Timeout for the TLS handshake of a new connection",
+				Value: 10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "responseHeaderTimeout",
+				Usage: "Timeout waiting for response headers after sending a request (0 is no limit)",
+			},
+			&cli.StringFlag{
+				Name:  "deadline",
+				Usage: "Stop gracefully at this time, saving any --checkpoint (RFC 3339 or YYYY-MM-DD)",
+			},
+			&cli.DurationFlag{
+				Name:  "runFor",
+				Usage: "Stop gracefully after running for this long, saving any --checkpoint",
+			},
+			&cli.DurationFlag{
+				Name:  "shutdownTimeout",
+				Usage: "How long to wait for in-flight batches after SIGINT or SIGTERM before exiting anyway",
+				Value: 30 * time.Second,
 			},
 			&cli.DurationFlag{
 				Name:  "rateDisplayInterval",
 				Usage: "Interval to display deletion rate",
 				Value: 5 * time.Second,
 			},
+			&cli.DurationFlag{
+				Name:  "rateWindow",
+				Usage: "Window over which the displayed deletion rate is measured",
+				Value: 30 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:  "metricsAddr",
+				Usage: "Serve Prometheus metrics on this address (e.g. :9090) at /metrics while running",
+			},
+			&cli.StringFlag{
+				Name:  "objectCountFrom",
+				Usage: "Get the approximate number of objects to purge at startup, for a percentage and ETA in the progress log: cloudwatch (AWS only, without --prefix) or the s3:// URL of an S3 Inventory manifest.json",
+			},
+			&cli.StringFlag{
+				Name:  "statusAddr",
+				Usage: "Serve the state of the run as JSON on this address (e.g. :8080) at /status while running, with a /healthz check",
+			},
+			&cli.StringFlag{
+				Name:  "otlpEndpoint",
+				Usage: "Send OpenTelemetry traces of listing pages, delete batches and S3 calls to this OTLP/HTTP collector (e.g. http://localhost:4318)",
+			},
+			&cli.BoolFlag{
+				Name:  "traceHttp",
+				Usage: "Log every S3 request attempt with its method, URL, status, latency and request IDs, e.g. for a provider's support",
+			},
+			&cli.StringFlag{
+				Name:  "pprofAddr",
+				Usage: "Serve net/http/pprof profiles on this address (e.g. localhost:6060) while running",
+			},
 			&cli.StringFlag{
 				Name:  "logLevel",
 				Usage: "Log level (debug, info, warn, error)",
 				Value: "info",
 			},
+			&cli.StringFlag{
+				Name:  "logFormat",
+				Usage: "Log format (text, or json for log pipelines)",
+				Value: "text",
+			},
 		},
-		Action: func(c *cli.Context) error {
-			endpoint := c.String("endpoint")
-			bucketName := c.String("bucket")
-			accessKeyID := c.String("accessKey")
-			secretAccessKey := c.String("secretKey")
+		Action: runPurge,
+	}
 
-			logLvl := new(slog.LevelVar)
-			logLvl.UnmarshalText([]byte(c.String("logLevel")))
-			slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-				Level: logLvl,
-			})))
-
-			slog.Info("Starting S3 purge", "endpoint", endpoint, "bucket", bucketName, "concurrency", c.Int64("concurrency"))
-
-			cfg, err := config.LoadDefaultConfig(context.TODO(),
-				config.WithEndpointResolver(aws.EndpointResolverFunc(
-					func(service, region string) (aws.Endpoint, error) {
-						return aws.Endpoint{
-							URL: endpoint,
-						}, nil
-					},
-				)),
-				config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, "")),
-			)
-			if err != nil {
-				return fmt.Errorf("unable to load SDK config: %v", err)
+	err := app.Run(os.Args)
+	if err != nil {
+		if !parsed {
+			err = configError{err}
+		}
+		log.Print(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// runPurge deletes whatever the flags select, or with the count command only
+// counts it.
+func runPurge(c *cli.Context) (err error) {
+	// Anything that stops the purge before it starts deleting is a
+	// problem with the flags, credentials or bucket
+	purging := false
+	defer func() {
+		if err != nil && !purging {
+			err = configError{err}
+		}
+	}()
+
+	endpoint := endpointNames(c)
+	bucketName := c.String("bucket")
+	prefix := c.String("prefix")
+
+	if err := checkProtected(c, bucketName); err != nil {
+		return err
+	}
+
+	// A failed keys manifest is just a CSV key file
+	if path := c.String("retryFrom"); path != "" {
+		for _, name := range []string{"keysFrom", "keysColumn", "versionColumn"} {
+			if c.IsSet(name) {
+				return fmt.Errorf("--retryFrom can't be used with --%s", name)
+			}
+		}
+		if !strings.EqualFold(filepath.Ext(path), ".csv") {
+			return fmt.Errorf("--retryFrom must be a .csv file written by --failedOut")
+		}
+		// Keys failing again would be appended to the file being read
+		if out := c.String("failedOut"); out != "" && filepath.Clean(out) == filepath.Clean(path) {
+			return fmt.Errorf("--failedOut must be a different file from --retryFrom")
+		}
+		if err := c.Set("keysFrom", path); err != nil {
+			return err
+		}
+	}
+
+	filter, err := newObjectFilter(c)
+	if err != nil {
+		return err
+	}
+	if _, _, err := parseConcurrency(c.String("concurrency")); err != nil {
+		return err
+	}
+	if c.Int("retries") < 0 || c.Duration("retryBackoff") <= 0 {
+		return fmt.Errorf("--retries must not be negative and --retryBackoff must be positive")
+	}
+	if c.Int("listRetries") < 0 {
+		return fmt.Errorf("--listRetries must not be negative")
+	}
+	if c.Int("prefixStats") < 0 {
+		return fmt.Errorf("--prefixStats must not be negative")
+	}
+	if c.Duration("rateDisplayInterval") <= 0 || c.Duration("rateWindow") <= 0 {
+		return fmt.Errorf("--rateDisplayInterval and --rateWindow must be positive")
+	}
+	batchSize, err := parseBatchSize(c)
+	if err != nil {
+		return err
+	}
+	if n := c.Int("canary"); n < 0 || n > batchSize {
+		return fmt.Errorf("--canary must be in the range [0, %d]", batchSize)
+	}
+	maxMemory, err := parseMaxMemory(c)
+	if err != nil {
+		return err
+	}
+	if maxMemory > 0 {
+		// Have the garbage collector work harder as the heap nears the
+		// limit, rather than letting it double first
+		debug.SetMemoryLimit(maxMemory)
+		concurrency, _, _ := parseConcurrency(c.String("concurrency"))
+		if n := memoryConcurrency(maxMemory, batchSize, concurrency); n < concurrency {
+			slog.Warn("Lowering the concurrency to fit --maxMemory", "concurrency", n, "maxMemory", formatBytes(uint64(maxMemory)))
+		}
+	}
+	if r := c.Float64("maxErrorRate"); r < 0 || r > 1 {
+		return fmt.Errorf("--maxErrorRate must be in the range [0, 1]")
+	}
+	if c.Int("keepVersions") < 0 {
+		return fmt.Errorf("--keepVersions must not be negative")
+	}
+	switch c.String("mode") {
+	case "", "permanent":
+	case "soft":
+		if listsVersions(c) {
+			return fmt.Errorf("--mode soft can't be used with version purges")
+		}
+	default:
+		return fmt.Errorf("--mode must be soft or permanent")
+	}
+	if c.Bool("deleteBucket") {
+		for _, name := range []string{"prefix", "prefixesFrom", "keysFrom", "multipartOnly", "maxObjects", "head", "sample",
+			"include", "exclude", "matchRegex", "excludeRegex", "olderThan", "newerThan", "modifiedAfter", "modifiedBefore",
+			"minSize", "maxSize", "zeroByteOnly", "directoryMarkers", "owner", "etagFrom", "skipArchived", "skipRestoring",
+			"filterExpr", "keepFrom", "ignoreFile", "tag", "contentType", "metadata", "unencryptedOnly",
+			"deleteMarkersOnly", "orphanMarkersOnly", "noncurrentOnly", "noncurrentOlderThan", "keepVersions"} {
+			if c.IsSet(name) {
+				return fmt.Errorf("--deleteBucket can't be used with --%s", name)
+			}
+		}
+	}
+	abortMultipart := c.Bool("abortMultipart") || c.Bool("multipartOnly") || c.Bool("deleteBucket")
+	if abortMultipart && c.String("keysFrom") != "" {
+		return fmt.Errorf("--abortMultipart can't be used with --keysFrom")
+	}
+	if c.IsSet("planOut") && c.String("keysFrom") != "" {
+		return fmt.Errorf("--planOut can't be used with --keysFrom")
+	}
+	if c.IsSet("applyPlan") {
+		for _, name := range []string{"prefix", "prefixesFrom", "keysFrom", "planOut", "dryRun", "multipartOnly", "deleteBucket"} {
+			if c.IsSet(name) {
+				return fmt.Errorf("--applyPlan can't be used with --%s", name)
+			}
+		}
+		if c.String("planHash") == "" {
+			return fmt.Errorf("--applyPlan requires --planHash with the approved snapshot hash")
+		}
+	} else if c.IsSet("planHash") {
+		return fmt.Errorf("--planHash requires --applyPlan")
+	}
+	if (c.Bool("shard") || c.IsSet("shardAlphabet")) && (c.IsSet("prefixesFrom") || c.IsSet("keysFrom") || c.IsSet("applyPlan")) {
+		return fmt.Errorf("--shard and --shardAlphabet only apply to listing a single --prefix")
+	}
+	if c.IsSet("shardAlphabet") {
+		if c.Bool("shard") {
+			return fmt.Errorf("--shard can't be used with --shardAlphabet")
+		}
+		if c.String("shardAlphabet") == "" || c.Int("shardDepth") < 1 || c.Int("shardDepth") > 4 {
+			return fmt.Errorf("--shardAlphabet must not be empty and --shardDepth must be in the range [1, 4]")
+		}
+		if n := keyRangeCount(c.String("shardAlphabet"), c.Int("shardDepth")); n > maxKeyRanges {
+			return fmt.Errorf("--shardAlphabet and --shardDepth make %d ranges, more than %d", n, maxKeyRanges)
+		}
+	}
+	if c.IsSet("checkpoint") {
+		for _, name := range []string{"keysFrom", "applyPlan", "dryRun", "planOut"} {
+			if c.IsSet(name) {
+				return fmt.Errorf("--checkpoint can't be used with --%s", name)
 			}
+		}
+		if counting(c) {
+			return fmt.Errorf("--checkpoint can't be used with count")
+		}
+		if c.Duration("checkpointInterval") <= 0 {
+			return fmt.Errorf("--checkpointInterval must be positive")
+		}
+	} else if c.Bool("resume") {
+		return fmt.Errorf("--resume requires --checkpoint")
+	}
+	var deadline time.Time
+	if s := c.String("deadline"); s != "" {
+		if c.IsSet("runFor") {
+			return fmt.Errorf("--deadline can't be used with --runFor")
+		}
+		if deadline, err = parseTime(s); err != nil {
+			return fmt.Errorf("invalid --deadline: %w", err)
+		}
+	} else if d := c.Duration("runFor"); d != 0 {
+		if d < 0 {
+			return fmt.Errorf("--runFor must be positive")
+		}
+		deadline = time.Now().Add(d)
+	}
+	if !deadline.IsZero() && !deadline.After(time.Now()) {
+		return fmt.Errorf("--deadline %s has already passed", deadline.Format(time.RFC3339))
+	}
+	if c.IsSet("objectCountFrom") {
+		for _, name := range []string{"prefixesFrom", "keysFrom", "multipartOnly"} {
+			if c.IsSet(name) {
+				return fmt.Errorf("--objectCountFrom can't be used with --%s", name)
+			}
+		}
+		if c.String("objectCountFrom") == "cloudwatch" && prefix != "" {
+			return fmt.Errorf("--objectCountFrom cloudwatch counts the whole bucket, so it can't be used with --prefix")
+		}
+	}
+	if c.Bool("summary") && c.String("keysFrom") == "-" {
+		return fmt.Errorf("--summary can't be used with --keysFrom -, since stdin can only be read once")
+	}
+	dryRun := c.Bool("dryRun") || counting(c) || c.IsSet("planOut")
+	if c.IsSet("auditLog") && dryRun {
+		return fmt.Errorf("--auditLog records deletions, so it can't be used with a dry run")
+	}
+	if dryRun {
+		for _, name := range []string{"suspendVersioning", "removeLegalHolds", "deleteBucket"} {
+			if c.Bool(name) {
+				return fmt.Errorf("--%s can't be used with --dryRun", name)
+			}
+		}
+	} else if c.IsSet("manifestOut") {
+		return fmt.Errorf("--manifestOut requires --dryRun")
+	}
+	if c.Bool("orphanMarkersOnly") && c.Int("keepVersions") > 0 {
+		return fmt.Errorf("--orphanMarkersOnly can't be used with --keepVersions")
+	}
+	if listsVersions(c) && c.String("keysFrom") != "" {
+		return fmt.Errorf("version purges can't be used with --keysFrom")
+	}
 
-			svc := s3.NewFromConfig(cfg)
+	slog.Info("Starting S3 purge", "endpoint", endpoint, "bucket", bucketName, "prefix", prefix, "concurrency", c.String("concurrency"), "dryRun", dryRun)
 
-			// Paginator to list all the objects in the bucket
-			paginator := s3.NewListObjectsV2Paginator(svc, &s3.ListObjectsV2Input{
-				Bucket: &bucketName,
-			})
+	if endpoint := c.String("otlpEndpoint"); endpoint != "" {
+		flushTraces, err := setupTracing(context.TODO(), endpoint)
+		if err != nil {
+			return err
+		}
+		defer flushTraces()
+	}
+	svc, err := newS3Client(c)
+	if err != nil {
+		return err
+	}
 
-			var wg sync.WaitGroup
-			deleteCounter := atomic.Uint64{}
-			startTime := time.Now()
+	// An approved plan already says exactly what gets deleted
+	if !dryRun && !c.IsSet("mode") && !c.Bool("allowVersioned") && !listsVersions(c) && !c.IsSet("applyPlan") {
+		if err := refuseVersioned(context.TODO(), svc, bucketName, c.String("keysFrom") != ""); err != nil {
+			return err
+		}
+	}
 
-			go func() {
-				for {
-					time.Sleep(c.Duration("rateDisplayInterval"))
-					duration := time.Since(startTime).Seconds()
-					rate := float64(deleteCounter.Load()) / duration
-					slog.Info(fmt.Sprintf("Current deletion rate: %.3f items/second", rate))
-				}
-			}()
+	lookups, err := newLookupFilter(c, svc, bucketName)
+	if err != nil {
+		return err
+	}
 
-			sem := make(chan struct{}, c.Int64("concurrency"))
+	var plan *purgePlan
+	var expected uint64
+	if path := c.String("applyPlan"); path != "" {
+		if plan, err = loadPlan(path, endpoint, bucketName, c.String("planHash")); err != nil {
+			return err
+		}
+		slog.Info("Loaded plan", "path", path, "created", plan.Created, "objects", plan.Objects, "bytes", formatBytes(plan.Bytes), "snapshot", plan.Snapshot)
+		expected = uint64(plan.Objects)
+	}
 
-			const batchSize = 500   // Group objects into batches of 500
-			var objectKeys []string // This slice will accumulate keys to delete in a batch
+	if c.Bool("summary") {
+		if expected, err = printSummary(c, svc, bucketName, filter, lookups, plan); err != nil {
+			return err
+		}
+	}
 
-			for paginator.HasMorePages() {
-				output, err := paginator.NextPage(context.TODO())
-				if err != nil {
-					return fmt.Errorf("failed to list objects: %v", err)
-				}
+	// Only worth counting when nothing more exact is known
+	if c.IsSet("objectCountFrom") && expected == 0 {
+		if n, err := objectCount(context.TODO(), c, svc, bucketName, prefix); err != nil {
+			slog.Warn("Couldn't get the object count, the progress won't show a percentage", "error", err)
+		} else {
+			slog.Info("Got the approximate object count", "objects", n, "from", c.String("objectCountFrom"))
+			expected = n
+		}
+	}
 
-				for _, item := range output.Contents {
-					objectKeys = append(objectKeys, aws.ToString(item.Key))
-
-					// If we have reached the batchSize, delete these objects as a batch
-					if len(objectKeys) == batchSize {
-						sem <- struct{}{} // Acquire concurrency slot
-						wg.Add(1)
-						go func(keysToDelete []string) {
-							defer func() {
-								<-sem // Release concurrency slot
-							}()
-							deleteObjects(svc, bucketName, keysToDelete, &wg, &deleteCounter)
-						}(objectKeys)
-						objectKeys = nil // Reset the slice for the next batch
-					}
-				}
+	if !dryRun && !c.Bool("yes") {
+		if err := confirmPurge(bucketName, endpoint); err != nil {
+			return err
+		}
+		if c.Bool("removeLegalHolds") {
+			if err := confirmRemoveLegalHolds(bucketName); err != nil {
+				return err
+			}
+		}
+	}
+
+	p := newPurger(c, svc, bucketName, filter, lookups)
+	defer p.close()
+	if c.IsSet("planOut") {
+		p.plan = &planRecorder{}
+	}
+	if path := c.String("manifestOut"); path != "" {
+		if p.manifest, err = newManifestWriter(path); err != nil {
+			return err
+		}
+	}
+	if path := c.String("failedOut"); path != "" {
+		if err := p.failures.openManifest(path, c.Bool("resume")); err != nil {
+			return err
+		}
+	}
+	if path := c.String("auditLog"); path != "" {
+		if p.audit, err = openAuditLog(path); err != nil {
+			return err
+		}
+	}
+	if serial := c.String("mfaSerial"); serial != "" {
+		if p.mfa, err = newMFAProvider(serial, c.String("mfaToken")); err != nil {
+			return err
+		}
+	}
+	if path := c.String("checkpoint"); path != "" {
+		if p.checkpoint, err = openCheckpoint(path, bucketName, p.versioned, c.Bool("resume")); err != nil {
+			return err
+		}
+		p.markers = p.checkpoint.markers()
+	}
+	if addr := c.String("metricsAddr"); addr != "" {
+		if err := serveMetrics(addr, p); err != nil {
+			return err
+		}
+	}
+	stop := handleSignals(p, c.Duration("shutdownTimeout"))
+	if p.manifest != nil {
+		stop.onExit(func() { p.manifest.close() })
+	}
+	stop.onExit(func() { p.failures.closeManifest() })
+	stop.onExit(func() { p.audit.close() })
+	if c.Bool("suspendVersioning") {
+		suspension, err := suspendVersioning(context.TODO(), svc, bucketName, p.mfa)
+		if err != nil {
+			return err
+		}
+		defer suspension.restore()
+		stop.onExit(suspension.restore)
+	}
+	// The ETA is based on the number of objects known to be left,
+	// if any, capped by --maxObjects
+	if p.maxObjects > 0 && (expected == 0 || p.maxObjects < expected) {
+		expected = p.maxObjects
+	}
+	started := time.Now()
+	logProgress(p, started, c.Duration("rateDisplayInterval"), c.Duration("rateWindow"), expected)
+	if addr := c.String("statusAddr"); addr != "" {
+		if err := serveStatus(addr, endpoint, p, started, c.Duration("rateWindow"), expected); err != nil {
+			return err
+		}
+	}
+	purging = true
+
+	stopAt(p, deadline)
+	p.checkpoint.run(p, c.Duration("checkpointInterval"))
+	// A failed listing still lets the batches already queued finish,
+	// and other prefixes of a parallel listing carry on regardless
+	sourceErr := runSource(c, p, plan)
+
+	p.wait() // Wait for all deletions to complete
+	abortErr := p.aborted()
+	if abortErr == nil && sourceErr != nil {
+		slog.Error("Listing failed, the purge is incomplete", "error", sourceErr)
+		abortErr = sourceErr
+	}
+	if err := p.checkpoint.close(p); err != nil {
+		return err
+	}
+	if p.manifest != nil {
+		if err := p.manifest.close(); err != nil {
+			return err
+		}
+		slog.Info("Wrote dry run manifest", "path", c.String("manifestOut"))
+	}
+	if p.plan != nil {
+		prefixes := []string{prefix}
+		if prefixesFrom := c.String("prefixesFrom"); prefixesFrom != "" {
+			if prefixes, err = readPrefixes(prefixesFrom, filter.ignoreCase); err != nil {
+				return err
 			}
+		}
+		for i := range prefixes {
+			prefixes[i] = serverPrefix(p, prefixes[i])
+		}
+		path := c.String("planOut")
+		snapshot, err := p.plan.write(c, path, prefixes, p.stats)
+		if err != nil {
+			return err
+		}
+		slog.Info("Wrote plan, review it and run with --applyPlan to execute it", "path", path, "objects", p.stats.deleted.Load(), "snapshot", snapshot)
+	}
 
-			// After exiting the loop, check if there are any remaining keys to delete
-			if len(objectKeys) > 0 {
-				sem <- struct{}{} // Acquire concurrency slot
-				wg.Add(1)
-				go deleteObjects(svc, bucketName, objectKeys, &wg, &deleteCounter)
+	var aborted atomic.Uint64
+	if abortMultipart && abortErr == nil {
+		prefixes := []string{prefix}
+		if prefixesFrom := c.String("prefixesFrom"); prefixesFrom != "" {
+			if prefixes, err = readPrefixes(prefixesFrom, filter.ignoreCase); err != nil {
+				return err
+			}
+		}
+		for _, prefix := range prefixes {
+			if err := abortMultipartUploads(context.TODO(), p, prefix, &aborted); err != nil {
+				return err
 			}
+		}
+	}
+	if c.Bool("deleteBucket") && abortErr == nil {
+		if err := deleteBucket(context.TODO(), p, &aborted); err != nil {
+			return err
+		}
+	}
+	if abortMultipart {
+		if dryRun {
+			slog.Info(fmt.Sprintf("Would abort %d incomplete multipart uploads", aborted.Load()))
+		} else {
+			slog.Info(fmt.Sprintf("Aborted %d incomplete multipart uploads", aborted.Load()))
+		}
+	}
 
-			wg.Wait() // Wait for all deletions to complete
-			slog.Info(fmt.Sprintf("Deleted %d objects", deleteCounter.Load()))
-			return nil
-		},
+	if p.done() && abortErr == nil {
+		slog.Info("Reached object limit, stopped early", "limit", p.maxObjects)
 	}
+	p.locks.report()
+	p.failures.report()
+	if err := p.failures.closeManifest(); err != nil {
+		return err
+	}
+	if err := p.audit.close(); err != nil {
+		return err
+	}
+	if n := p.failures.total() + uint64(p.locks.total()); n > 0 && c.IsSet("failedOut") {
+		slog.Info("Wrote failed keys manifest, pass it to --retryFrom to try them again", "path", c.String("failedOut"), "objects", n)
+	}
+	if n := p.archived.Load(); n > 0 {
+		slog.Warn(fmt.Sprintf("Left %d archived objects in place", n))
+	}
+	if n := p.restoring.Load(); n > 0 {
+		slog.Warn(fmt.Sprintf("Left %d objects with a restore in progress in place", n))
+	}
+	if n := p.recent.Load(); n > 0 {
+		slog.Warn(fmt.Sprintf("Left %d objects modified within --safetyMinAge in place", n), "safetyMinAge", c.String("safetyMinAge"))
+	}
+	result := newRunResult(c, p, started, abortErr)
+	if url := c.String("notifyUrl"); url != "" {
+		// A failed notification doesn't change the outcome of the run
+		if err := notify(url, result); err != nil {
+			slog.Warn("Couldn't send the completion notification", "error", err)
+		}
+	}
+	if path := c.String("summaryOut"); path != "" {
+		if err := result.write(path); err != nil {
+			return err
+		}
+		slog.Info("Wrote run summary", "path", path)
+	}
+	if p.stats.prefixes != nil {
+		p.stats.prefixes.print(os.Stderr)
+	}
+	if counting(c) {
+		deleted := p.stats.deleted.Load()
+		slog.Info(fmt.Sprintf("Matched %d objects (%s)", deleted, formatBytes(p.stats.bytes.Load())),
+			"deleteRequests", (deleted+uint64(p.batchSize)-1)/uint64(p.batchSize), "skipped", p.skipped.Load(), "lookupErrors", p.lookupErrors.Load())
+		return sourceErr
+	}
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	slog.Info(fmt.Sprintf("%s %d objects (%s)", verb, p.stats.deleted.Load(), formatBytes(p.stats.bytes.Load())),
+		"objects", p.stats.deleted.Load(), "bytes", p.stats.bytes.Load(), "skipped", p.skipped.Load(), "lookupErrors", p.lookupErrors.Load(), "failed", p.failures.total(), "failedBatches", p.failedBatches.Load(), "alreadyDeleted", p.alreadyGone.Load())
+	if p.checkpoint != nil {
+		deleted, bytes := p.checkpoint.totals(p)
+		slog.Info(fmt.Sprintf("Deleted %d objects (%s) in total since the checkpoint was started", deleted, formatBytes(bytes)))
+	}
+	switch {
+	case errors.Is(abortErr, errInterrupted):
+		return cli.Exit("s3purge: interrupted before the purge finished", exitInterrupted)
+	case errors.Is(abortErr, errDeadline):
+		return cli.Exit("s3purge: reached the deadline before the purge finished", exitInterrupted)
+	case abortErr == nil:
+		if n := p.failures.total() + uint64(p.locks.total()); n > 0 {
+			return cli.Exit(fmt.Sprintf("s3purge: %d objects couldn't be deleted", n), exitFailedDeletes)
+		}
+	}
+	return abortErr
+}
 
-	err := app.Run(os.Args)
-	if err != nil {
-		log.Fatal(err)
+// runSource feeds the purger from the source selected by the flags.
+func runSource(c *cli.Context, p *purger, plan *purgePlan) error {
+	ctx := context.TODO()
+	prefix := c.String("prefix")
+	switch {
+	case plan != nil:
+		return applyPlan(ctx, p, plan, c.Float64("maxDrift"))
+	case c.Bool("multipartOnly"):
+		// Skip the object purge entirely
+		return nil
+	case c.String("keysFrom") != "":
+		return readKeys(ctx, p, c.String("keysFrom"), c.String("keysColumn"), c.String("versionColumn"), c.Duration("idleFlush"))
+	case c.String("prefixesFrom") != "":
+		return listPrefixesFrom(ctx, p, c.String("prefixesFrom"), c.Int("listConcurrency"))
+	case c.String("shardAlphabet") != "":
+		return listKeyRanges(ctx, p, prefix, c.String("shardAlphabet"), c.Int("shardDepth"), c.Int("listConcurrency"))
+	case c.Bool("shard"):
+		return listSharded(ctx, p, prefix, c.Int("listConcurrency"))
+	default:
+		return listPrefix(ctx, p, prefix)
+	}
+}
+
+// printSummary runs the source once without deleting anything and prints a
+// du-style breakdown of what the purge would delete. It returns the number
+// of matching objects.
+func printSummary(c *cli.Context, svc *s3.Client, bucketName string, filter *objectFilter, lookups *lookupFilter, plan *purgePlan) (uint64, error) {
+	slog.Info("Listing matching objects for the summary")
+	p := newPurger(c, svc, bucketName, filter, lookups)
+	defer p.close()
+	p.dryRun = true
+	p.summary = newPrefixSummary(filter.prefix, 1)
+	if err := runSource(c, p, plan); err != nil {
+		return 0, err
 	}
+	p.wait()
+	p.summary.print(os.Stderr)
+	return p.stats.deleted.Load(), nil
 }
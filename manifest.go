@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// manifestEntry is one line of a JSONL key manifest. Only the key and
+// version ID are read back by --keysFrom.
+type manifestEntry struct {
+	Key          string     `json:"key"`
+	VersionId    string     `json:"versionId,omitempty"`
+	Size         *int64     `json:"size,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+}
+
+// manifestWriter records the objects a dry run would delete. The output is
+// JSONL if the path ends in .jsonl or .ndjson and CSV otherwise, in both
+// cases readable by --keysFrom. Writes may come from several batches at
+// once.
+type manifestWriter struct {
+	mu   sync.Mutex
+	f    *os.File
+	buf  *bufio.Writer
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+func newManifestWriter(path string) (*manifestWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create manifest: %w", err)
+	}
+	m := &manifestWriter{f: f, buf: bufio.NewWriter(f)}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		m.json = json.NewEncoder(m.buf)
+	default:
+		m.csv = csv.NewWriter(m.buf)
+		m.csv.Write([]string{"key", "versionId", "size", "lastModified"})
+	}
+	return m, nil
+}
+
+// write appends a batch of objects to the manifest.
+func (m *manifestWriter) write(objects []object) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, obj := range objects {
+		var err error
+		if m.json != nil {
+			entry := manifestEntry{Key: aws.ToString(obj.Key), VersionId: aws.ToString(obj.VersionId)}
+			if obj.LastModified != nil {
+				entry.Size = aws.Int64(obj.Size)
+				entry.LastModified = obj.LastModified
+			}
+			err = m.json.Encode(entry)
+		} else {
+			var size, lastModified string
+			if obj.LastModified != nil {
+				size = strconv.FormatInt(obj.Size, 10)
+				lastModified = obj.LastModified.UTC().Format(time.RFC3339)
+			}
+			err = m.csv.Write([]string{aws.ToString(obj.Key), aws.ToString(obj.VersionId), size, lastModified})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write manifest: %w", err)
+		}
+	}
+	return nil
+}
+
+// close flushes and closes the manifest.
+func (m *manifestWriter) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.csv != nil {
+		m.csv.Flush()
+		if err := m.csv.Error(); err != nil {
+			return fmt.Errorf("failed to write manifest: %w", err)
+		}
+	}
+	if err := m.buf.Flush(); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return m.f.Close()
+}
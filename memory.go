@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// objectMemoryEstimate is roughly how much memory a listed object takes
+// while it waits to be deleted, including its key, listing metadata and
+// its share of the request and response bodies.
+const objectMemoryEstimate = 1 << 10
+
+// parseMaxMemory returns --maxMemory in bytes, or 0 if it isn't set.
+func parseMaxMemory(c *cli.Context) (int64, error) {
+	s := c.String("maxMemory")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --maxMemory: %w", err)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("--maxMemory must be positive")
+	}
+	return n, nil
+}
+
+// memoryConcurrency lowers the concurrency so the batches in flight fit in
+// half of maxMemory, leaving the rest for queued pages, retries and the
+// runtime. A zero maxMemory leaves it unchanged.
+func memoryConcurrency(maxMemory int64, batchSize, concurrency int) int {
+	if maxMemory == 0 {
+		return concurrency
+	}
+	fits := maxMemory / 2 / int64(batchSize*objectMemoryEstimate)
+	return int(max(1, min(int64(concurrency), fits)))
+}
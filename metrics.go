@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// requestMetrics records the latency and outcome of every S3 request
+// attempt, by operation, for --metricsAddr.
+type requestMetrics struct {
+	mu      sync.Mutex
+	latency map[string]*histogram
+	errors  map[requestError]uint64
+}
+
+type requestError struct {
+	operation string
+	code      string
+}
+
+type histogram struct {
+	buckets []uint64 // Not cumulative, the last one is +Inf
+	count   uint64
+	sum     float64
+}
+
+var s3Requests = &requestMetrics{
+	latency: make(map[string]*histogram),
+	errors:  make(map[requestError]uint64),
+}
+
+// middleware times each attempt of a request, after the SDK's retries so
+// that every attempt is seen.
+func (m *requestMetrics) middleware(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("RequestMetrics", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		start := time.Now()
+		out, metadata, err := next.HandleFinalize(ctx, in)
+		m.observe(awsmiddleware.GetOperationName(ctx), time.Since(start), err)
+		return out, metadata, err
+	}), middleware.After)
+}
+
+func (m *requestMetrics) observe(operation string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.latency[operation]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets)+1)}
+		m.latency[operation] = h
+	}
+	seconds := elapsed.Seconds()
+	h.buckets[sort.SearchFloat64s(latencyBuckets, seconds)]++
+	h.count++
+	h.sum += seconds
+	if err != nil {
+		m.errors[requestError{operation: operation, code: errorCode(err)}]++
+	}
+}
+
+// serveMetrics serves the purge's metrics on addr in the Prometheus text
+// format for the rest of the process. Listening happens up front so a bad
+// address fails the run straight away.
+func serveMetrics(addr string, p *purger) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on --metricsAddr: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, p)
+	})
+
+	slog.Info("Serving metrics", "url", fmt.Sprintf("http://%s/metrics", ln.Addr()))
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("metrics server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+func writeMetrics(w io.Writer, p *purger) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("s3purge_objects_deleted_total", "counter", "Objects deleted, or that would be deleted in a dry run.")
+	fmt.Fprintf(w, "s3purge_objects_deleted_total %d\n", p.stats.deleted.Load())
+	metric("s3purge_bytes_deleted_total", "counter", "Bytes deleted, or that would be deleted in a dry run.")
+	fmt.Fprintf(w, "s3purge_bytes_deleted_total %d\n", p.stats.bytes.Load())
+	metric("s3purge_objects_skipped_total", "counter", "Listed objects that didn't match the filters.")
+	fmt.Fprintf(w, "s3purge_objects_skipped_total %d\n", p.skipped.Load())
+	metric("s3purge_objects_failed_total", "counter", "Objects given up on, by error code.")
+	for _, f := range p.failures.byCode() {
+		fmt.Fprintf(w, "s3purge_objects_failed_total{code=%s} %d\n", labelValue(f.code), f.count)
+	}
+	metric("s3purge_batches_in_flight", "gauge", "DeleteObjects calls in flight.")
+	fmt.Fprintf(w, "s3purge_batches_in_flight %d\n", p.throttle.active())
+	metric("s3purge_delete_concurrency", "gauge", "DeleteObjects calls currently allowed in flight.")
+	fmt.Fprintf(w, "s3purge_delete_concurrency %d\n", p.throttle.current())
+	metric("s3purge_failed_batches_total", "counter", "DeleteObjects calls that failed outright.")
+	fmt.Fprintf(w, "s3purge_failed_batches_total %d\n", p.failedBatches.Load())
+	metric("s3purge_list_pages_total", "counter", "Listing pages fetched.")
+	fmt.Fprintf(w, "s3purge_list_pages_total %d\n", p.listPages.Load())
+
+	s3Requests.mu.Lock()
+	defer s3Requests.mu.Unlock()
+
+	failed := make([]requestError, 0, len(s3Requests.errors))
+	for e := range s3Requests.errors {
+		failed = append(failed, e)
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		if failed[i].operation != failed[j].operation {
+			return failed[i].operation < failed[j].operation
+		}
+		return failed[i].code < failed[j].code
+	})
+	metric("s3purge_request_errors_total", "counter", "S3 request attempts that failed, by operation and error code.")
+	for _, e := range failed {
+		fmt.Fprintf(w, "s3purge_request_errors_total{operation=%s,code=%s} %d\n", labelValue(e.operation), labelValue(e.code), s3Requests.errors[e])
+	}
+
+	operations := make([]string, 0, len(s3Requests.latency))
+	for op := range s3Requests.latency {
+		operations = append(operations, op)
+	}
+	sort.Strings(operations)
+	metric("s3purge_request_duration_seconds", "histogram", "Latency of S3 request attempts, by operation.")
+	for _, op := range operations {
+		h := s3Requests.latency[op]
+		var cumulative uint64
+		for i, n := range h.buckets {
+			cumulative += n
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = fmt.Sprint(latencyBuckets[i])
+			}
+			fmt.Fprintf(w, "s3purge_request_duration_seconds_bucket{operation=%s,le=%q} %d\n", labelValue(op), le, cumulative)
+		}
+		fmt.Fprintf(w, "s3purge_request_duration_seconds_sum{operation=%s} %g\n", labelValue(op), h.sum)
+		fmt.Fprintf(w, "s3purge_request_duration_seconds_count{operation=%s} %d\n", labelValue(op), h.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes a label value for the Prometheus text format.
+func labelValue(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
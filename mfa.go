@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/aws/smithy-go"
+)
+
+// mfaProvider supplies the x-amz-mfa header for buckets with MFA Delete
+// enabled. TOTP codes expire, so when the provider rejects a request the
+// operator is prompted for a fresh code on the terminal; concurrent batches
+// that hit the same rejection share a single prompt.
+type mfaProvider struct {
+	serial string
+
+	mu         sync.Mutex
+	token      string
+	generation int
+}
+
+// newMFAProvider prompts for the initial token if one wasn't given.
+func newMFAProvider(serial, token string) (*mfaProvider, error) {
+	m := &mfaProvider{serial: serial, token: token}
+	if m.token == "" {
+		var err error
+		if m.token, err = promptMFAToken(serial); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// header returns the MFA header value along with the generation of the
+// token it contains, to be passed to refresh if the token is rejected.
+func (m *mfaProvider) header() (string, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.serial + " " + m.token, m.generation
+}
+
+// refresh prompts for a new token unless another batch already replaced the
+// rejected one.
+func (m *mfaProvider) refresh(rejected int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rejected != m.generation {
+		return nil
+	}
+	slog.Warn("MFA token rejected, it has probably expired")
+	token, err := promptMFAToken(m.serial)
+	if err != nil {
+		return err
+	}
+	m.token = token
+	m.generation++
+	return nil
+}
+
+// promptMFAToken reads a TOTP code from the terminal.
+func promptMFAToken(serial string) (string, error) {
+	token, err := promptTTY(fmt.Sprintf("Enter MFA code for %s: ", serial))
+	if err != nil {
+		return "", fmt.Errorf("an MFA token is required: %w", err)
+	}
+	if token == "" {
+		return "", fmt.Errorf("no MFA code entered")
+	}
+	return token, nil
+}
+
+// isMFAError reports whether a request was rejected for a missing or
+// invalid MFA token.
+func isMFAError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "AccessDenied", "InvalidRequest":
+		return strings.Contains(strings.ToLower(apiErr.ErrorMessage()), "mfa")
+	}
+	return false
+}
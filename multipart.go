@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// abortMultipartUploads aborts every incomplete multipart upload under the
+// prefix whose key passes the key filters, up to the purger's concurrency at
+// a time. The age and modification time filters apply to when each upload
+// was initiated, so uploads still being written by live clients can be left
+// alone. Incomplete uploads aren't listed as objects, yet they consume
+// storage and keep the bucket from being deleted.
+func abortMultipartUploads(ctx context.Context, p *purger, prefix string, aborted *atomic.Uint64) error {
+	listPrefix := serverPrefix(p, prefix)
+
+	listInput := &s3.ListMultipartUploadsInput{
+		Bucket: &p.bucketName,
+	}
+	if listPrefix != "" {
+		listInput.Prefix = &listPrefix
+	}
+	paginator := s3.NewListMultipartUploadsPaginator(p.svc, listInput)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, p.concurrency)
+
+	for paginator.HasMorePages() {
+		output, err := nextPage(ctx, p, paginator.NextPage)
+		if err != nil {
+			return fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+		for _, upload := range output.Uploads {
+			key := aws.ToString(upload.Key)
+			if !hasPrefix(key, prefix, p.filter.ignoreCase) || !p.filter.matchKey(key) ||
+				!p.filter.inTimeWindow(aws.ToTime(upload.Initiated)) {
+				slog.Debug("skipping multipart upload", "key", key, "uploadId", aws.ToString(upload.UploadId))
+				continue
+			}
+
+			if p.dryRun {
+				slog.Log(ctx, p.deletedLogLevel, "would abort multipart upload", "key", key, "uploadId", aws.ToString(upload.UploadId))
+				aborted.Add(1)
+				continue
+			}
+
+			sem <- struct{}{} // Acquire concurrency slot
+			wg.Add(1)
+			go func(upload types.MultipartUpload) {
+				defer func() {
+					<-sem // Release concurrency slot
+					wg.Done()
+				}()
+				_, err := p.svc.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+					Bucket:   &p.bucketName,
+					Key:      upload.Key,
+					UploadId: upload.UploadId,
+				})
+				if err != nil {
+					slog.Error("failed to abort multipart upload", "key", aws.ToString(upload.Key), "uploadId", aws.ToString(upload.UploadId), "error", err)
+					return
+				}
+				slog.Log(ctx, p.deletedLogLevel, "aborted multipart upload", "key", aws.ToString(upload.Key), "uploadId", aws.ToString(upload.UploadId))
+				aborted.Add(1)
+			}(upload)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// notifyTimeout bounds how long the completion notification may take, so a
+// dead webhook can't hold up the exit.
+const notifyTimeout = 10 * time.Second
+
+// notification is the payload POSTed to --notifyUrl: the run summary, plus a
+// text line that Slack-compatible webhooks display as the message.
+type notification struct {
+	Text string `json:"text"`
+	*runResult
+}
+
+// notify POSTs the outcome of the run to a webhook.
+func notify(url string, r *runResult) error {
+	text := fmt.Sprintf("s3purge %s on bucket %s: deleted %d objects (%s) in %s",
+		r.Status, r.Bucket, r.Deleted, formatBytes(r.Bytes), time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Second))
+	if r.DryRun {
+		text = fmt.Sprintf("s3purge dry run %s on bucket %s: would delete %d objects (%s)", r.Status, r.Bucket, r.Deleted, formatBytes(r.Bytes))
+	}
+	if r.Failed > 0 {
+		text += fmt.Sprintf(", %d failed", r.Failed)
+	}
+	if r.Error != "" {
+		text += ": " + r.Error
+	}
+
+	data, err := json.Marshal(notification{Text: text, runResult: r})
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("notification webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// object is a deletion candidate from any source: an object listing, a
+// version listing or a key file. Version fields are only set for objects
+// from a version listing, in which case deleting the object permanently
+// removes that version.
+type object struct {
+	types.Object
+
+	VersionId    *string
+	IsLatest     bool
+	DeleteMarker bool
+}
+
+// keyObject is a candidate known only by its key, e.g. from a key file.
+func keyObject(key string) object {
+	return object{Object: types.Object{Key: aws.String(key)}}
+}
+
+// keyVersionObject is a candidate naming a specific version of a key, e.g.
+// from a manifest. An empty versionId refers to the key itself.
+func keyVersionObject(key, versionId string) object {
+	obj := keyObject(key)
+	if versionId != "" {
+		obj.VersionId = aws.String(versionId)
+	}
+	return obj
+}
+
+func objectsFromListing(contents []types.Object) []object {
+	objects := make([]object, len(contents))
+	for i := range contents {
+		objects[i] = object{Object: contents[i], IsLatest: true}
+	}
+	return objects
+}
+
+func objectFromVersion(v types.ObjectVersion) object {
+	return object{
+		Object: types.Object{
+			ChecksumAlgorithm: v.ChecksumAlgorithm,
+			ETag:              v.ETag,
+			Key:               v.Key,
+			LastModified:      v.LastModified,
+			Owner:             v.Owner,
+			RestoreStatus:     v.RestoreStatus,
+			Size:              v.Size,
+			StorageClass:      types.ObjectStorageClass(v.StorageClass),
+		},
+		VersionId: v.VersionId,
+		IsLatest:  v.IsLatest,
+	}
+}
+
+func objectFromDeleteMarker(m types.DeleteMarkerEntry) object {
+	return object{
+		Object: types.Object{
+			Key:          m.Key,
+			LastModified: m.LastModified,
+			Owner:        m.Owner,
+		},
+		VersionId:    m.VersionId,
+		IsLatest:     m.IsLatest,
+		DeleteMarker: true,
+	}
+}
+
+// identifier is the DeleteObjects identifier for the object (or version).
+func (o object) identifier() types.ObjectIdentifier {
+	return types.ObjectIdentifier{
+		Key:       o.Key,
+		VersionId: o.VersionId,
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/urfave/cli/v2"
+)
+
+// objectCount returns the approximate number of objects to purge, for
+// --objectCountFrom: either the bucket's NumberOfObjects metric from
+// CloudWatch, or the number of objects under the prefix in an S3 Inventory
+// report, given the s3:// URL of its manifest.json.
+func objectCount(ctx context.Context, c *cli.Context, svc *s3.Client, bucketName, prefix string) (uint64, error) {
+	from := c.String("objectCountFrom")
+	if from == "cloudwatch" {
+		return cloudWatchObjectCount(ctx, c, bucketName)
+	}
+	u, err := url.Parse(from)
+	if err != nil || u.Scheme != "s3" || u.Host == "" || u.Path == "" {
+		return 0, fmt.Errorf("--objectCountFrom must be cloudwatch or the s3:// URL of an inventory manifest.json")
+	}
+	return inventoryObjectCount(ctx, svc, u.Host, strings.TrimPrefix(u.Path, "/"), prefix, c.Bool("ignoreCase"), listsVersions(c), c.Int("listConcurrency"))
+}
+
+// cloudWatchObjectCount returns the bucket's most recent NumberOfObjects
+// metric, which S3 reports once a day. The region's CloudWatch endpoint is
+// used whatever --endpoint is, so this only works for AWS.
+func cloudWatchObjectCount(ctx context.Context, c *cli.Context, bucketName string) (uint64, error) {
+	cfg, err := loadSDKConfig(c)
+	if err != nil {
+		return 0, err
+	}
+	if cfg.Region == "" {
+		return 0, fmt.Errorf("CloudWatch needs the bucket's region, set AWS_REGION")
+	}
+	output, err := cloudwatch.NewFromConfig(cfg).GetMetricStatistics(ctx, &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/S3"),
+		MetricName: aws.String("NumberOfObjects"),
+		Dimensions: []cwtypes.Dimension{
+			{Name: aws.String("BucketName"), Value: &bucketName},
+			{Name: aws.String("StorageType"), Value: aws.String("AllStorageTypes")},
+		},
+		StartTime:  aws.Time(time.Now().Add(-3 * 24 * time.Hour)),
+		EndTime:    aws.Time(time.Now()),
+		Period:     aws.Int32(24 * 60 * 60),
+		Statistics: []cwtypes.Statistic{cwtypes.StatisticAverage},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the NumberOfObjects metric: %w", err)
+	}
+	if len(output.Datapoints) == 0 {
+		return 0, fmt.Errorf("no NumberOfObjects metric for the bucket in the last 3 days")
+	}
+	latest := output.Datapoints[0]
+	for _, d := range output.Datapoints[1:] {
+		if aws.ToTime(d.Timestamp).After(aws.ToTime(latest.Timestamp)) {
+			latest = d
+		}
+	}
+	return uint64(aws.ToFloat64(latest.Average)), nil
+}
+
+// inventoryManifest is the part of an S3 Inventory manifest.json needed to
+// read the report.
+type inventoryManifest struct {
+	DestinationBucket string `json:"destinationBucket"` // An ARN
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// inventoryObjectCount counts the objects under the prefix in the CSV S3
+// Inventory report with the given manifest, reading its files concurrently.
+// Only current objects are counted unless versions is set, if the report
+// says which they are.
+func inventoryObjectCount(ctx context.Context, svc *s3.Client, bucket, key, prefix string, ignoreCase, versions bool, concurrency int) (uint64, error) {
+	output, err := svc.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the inventory manifest: %w", err)
+	}
+	var manifest inventoryManifest
+	err = json.NewDecoder(output.Body).Decode(&manifest)
+	output.Body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the inventory manifest: %w", err)
+	}
+	if manifest.FileFormat != "CSV" {
+		return 0, fmt.Errorf("only CSV inventory reports are supported, not %s", manifest.FileFormat)
+	}
+	columns := make(map[string]int)
+	for i, name := range strings.Split(manifest.FileSchema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	keyColumn, ok := columns["Key"]
+	if !ok {
+		return 0, fmt.Errorf("the inventory report has no Key column")
+	}
+	latestColumn, hasLatest := columns["IsLatest"]
+	markerColumn, hasMarker := columns["IsDeleteMarker"]
+	// The destination bucket's ARN is arn:aws:s3:::name
+	reportBucket := manifest.DestinationBucket[strings.LastIndexByte(manifest.DestinationBucket, ':')+1:]
+
+	countRow := func(row []string) bool {
+		if !versions && ((hasLatest && row[latestColumn] != "true") || (hasMarker && row[markerColumn] == "true")) {
+			return false
+		}
+		if prefix == "" {
+			return true
+		}
+		// Keys are URL-encoded
+		key, err := url.QueryUnescape(row[keyColumn])
+		if err != nil {
+			key = row[keyColumn]
+		}
+		return hasPrefix(key, prefix, ignoreCase)
+	}
+
+	slog.Info("Counting objects in the inventory report", "manifest", fmt.Sprintf("s3://%s/%s", bucket, key), "files", len(manifest.Files))
+	var (
+		count    atomic.Uint64
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, max(1, concurrency))
+	for _, file := range manifest.Files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(fileKey string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			n, err := countInventoryFile(ctx, svc, reportBucket, fileKey, len(columns), countRow)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+			count.Add(n)
+		}(file.Key)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return count.Load(), nil
+}
+
+// countInventoryFile counts the rows of a gzipped CSV inventory file that
+// countRow accepts.
+func countInventoryFile(ctx context.Context, svc *s3.Client, bucket, key string, columns int, countRow func([]string) bool) (uint64, error) {
+	output, err := svc.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read inventory file %s: %w", key, err)
+	}
+	defer output.Body.Close()
+	gz, err := gzip.NewReader(output.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read inventory file %s: %w", key, err)
+	}
+	r := csv.NewReader(gz)
+	r.FieldsPerRecord = columns
+	r.ReuseRecord = true
+
+	var n uint64
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read inventory file %s: %w", key, err)
+		}
+		if countRow(row) {
+			n++
+		}
+	}
+}
+
+// percentDone returns how much of the expected number of objects has been
+// deleted as a percentage, rounded down to one decimal place and capped at
+// 100 since the count may be approximate.
+func percentDone(deleted, expected uint64) float64 {
+	return min(100, math.Floor(float64(deleted)*1000/float64(expected))/10)
+}
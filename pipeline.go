@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// pageQueueDepth is how many listed pages may wait to be filtered, beyond
+// the one being filtered, before the listing has to wait.
+const pageQueueDepth = 4
+
+// pageQueue decouples a listing from filtering and batching its pages, so
+// the next page is fetched while lookups for the last one run and its
+// batches wait for a worker. Each queue has a single goroutine taking pages
+// in listing order, and the bounded channel holds the listing back once
+// filtering or deleting falls behind.
+type pageQueue struct {
+	pages chan queuedPage
+	done  chan struct{}
+	once  sync.Once
+}
+
+type queuedPage struct {
+	objects []object
+	// Called once the page has been submitted, e.g. to advance the
+	// checkpoint past it
+	then func()
+}
+
+func newPageQueue(ctx context.Context, p *purger) *pageQueue {
+	q := &pageQueue{
+		pages: make(chan queuedPage, pageQueueDepth),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(q.done)
+		for page := range q.pages {
+			p.submit(ctx, page.objects, false)
+			if page.then != nil && !p.done() {
+				page.then()
+			}
+		}
+	}()
+	return q
+}
+
+// push queues a page of listed objects for submission, blocking while the
+// queue is full. then may be nil.
+func (q *pageQueue) push(objects []object, then func()) {
+	q.pages <- queuedPage{objects: objects, then: then}
+}
+
+// close waits for every queued page to be submitted. It's safe to call more
+// than once.
+func (q *pageQueue) close() {
+	q.once.Do(func() { close(q.pages) })
+	<-q.done
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/urfave/cli/v2"
+)
+
+// planVersion is bumped whenever the plan format changes incompatibly.
+const planVersion = 1
+
+// purgePlan is the output of a --planOut run: everything needed to review a
+// purge and later execute exactly that purge with --applyPlan.
+type purgePlan struct {
+	Version  int               `json:"version"`
+	Created  time.Time         `json:"created"`
+	Endpoint string            `json:"endpoint"`
+	Bucket   string            `json:"bucket"`
+	Flags    map[string]string `json:"flags"`
+	// Listing prefixes that cover every planned object, and whether they
+	// were listed by version
+	Prefixes []string `json:"prefixes"`
+	Versions bool     `json:"versions"`
+
+	Objects int    `json:"objects"`
+	Bytes   uint64 `json:"bytes"`
+	// SHA-256 of the entries, to be approved out-of-band and passed back
+	// with --planHash
+	Snapshot string      `json:"snapshot"`
+	Entries  []planEntry `json:"entries"`
+}
+
+// planEntry is a planned deletion along with the state it was planned
+// against.
+type planEntry struct {
+	Key          string     `json:"key"`
+	VersionId    string     `json:"versionId,omitempty"`
+	Size         int64      `json:"size"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	DeleteMarker bool       `json:"deleteMarker,omitempty"`
+}
+
+// secretFlags are flags never recorded in a plan or run summary.
+var secretFlags = map[string]bool{"accessKey": true, "secretKey": true, "sessionToken": true, "mfaToken": true, "notifyUrl": true}
+
+// setFlags returns the value of every flag set on the command line, apart
+// from secrets.
+func setFlags(c *cli.Context) map[string]string {
+	flags := make(map[string]string)
+	for _, flag := range c.App.Flags {
+		name := flag.Names()[0]
+		if !c.IsSet(name) || secretFlags[name] {
+			continue
+		}
+		if _, ok := flag.(*cli.StringSliceFlag); ok {
+			flags[name] = strings.Join(c.StringSlice(name), ",")
+		} else {
+			flags[name] = fmt.Sprint(c.Value(name))
+		}
+	}
+	return flags
+}
+
+// planRecorder collects the objects a planning run would delete. Writes may
+// come from several batches at once.
+type planRecorder struct {
+	mu      sync.Mutex
+	entries []planEntry
+}
+
+func (r *planRecorder) record(objects []object) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, obj := range objects {
+		r.entries = append(r.entries, planEntry{
+			Key:          aws.ToString(obj.Key),
+			VersionId:    aws.ToString(obj.VersionId),
+			Size:         obj.Size,
+			ETag:         aws.ToString(obj.ETag),
+			LastModified: obj.LastModified,
+			DeleteMarker: obj.DeleteMarker,
+		})
+	}
+}
+
+// write saves the plan for the recorded objects, scoped to the given
+// listing prefixes, and returns its snapshot hash.
+func (r *planRecorder) write(c *cli.Context, path string, prefixes []string, stats *purgeStats) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	plan := &purgePlan{
+		Version:  planVersion,
+		Created:  time.Now().UTC(),
+		Endpoint: endpointNames(c),
+		Bucket:   c.String("bucket"),
+		Flags:    setFlags(c),
+		Prefixes: prefixes,
+		Versions: listsVersions(c),
+		Objects:  len(r.entries),
+		Bytes:    stats.bytes.Load(),
+		Entries:  r.entries,
+	}
+	sortPlanEntries(plan.Entries)
+	plan.Snapshot = snapshotHash(plan.Entries)
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode plan: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write plan: %w", err)
+	}
+	return plan.Snapshot, nil
+}
+
+func sortPlanEntries(entries []planEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].VersionId < entries[j].VersionId
+	})
+}
+
+// snapshotHash hashes the identity and state of every (sorted) entry.
+func snapshotHash(entries []planEntry) string {
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00%s\n", e.Key, e.VersionId, e.Size, e.ETag)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadPlan reads a plan and checks that it's intact, that it targets this
+// endpoint and bucket and that it's the approved plan, wantHash.
+func loadPlan(path, endpoint, bucketName, wantHash string) (*purgePlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan: %w", err)
+	}
+	var plan purgePlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse plan: %w", err)
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("plan has unsupported version %d", plan.Version)
+	}
+	if plan.Endpoint != endpoint || plan.Bucket != bucketName {
+		return nil, fmt.Errorf("plan is for bucket %s at %s, not %s at %s", plan.Bucket, plan.Endpoint, bucketName, endpoint)
+	}
+	sortPlanEntries(plan.Entries)
+	if hash := snapshotHash(plan.Entries); hash != plan.Snapshot {
+		return nil, fmt.Errorf("plan entries don't match its snapshot hash, it has been modified")
+	}
+	if !strings.EqualFold(wantHash, plan.Snapshot) {
+		return nil, fmt.Errorf("plan snapshot %s is not the approved snapshot %s", plan.Snapshot, wantHash)
+	}
+	return &plan, nil
+}
+
+// applyPlan re-lists the plan's prefixes and deletes the planned objects
+// that are still present and unchanged. Nothing is deleted if more than
+// maxDrift of the planned objects have since disappeared or changed.
+func applyPlan(ctx context.Context, p *purger, plan *purgePlan, maxDrift float64) error {
+	planned := make(map[string]planEntry, len(plan.Entries))
+	for _, e := range plan.Entries {
+		planned[versionKey(e.Key, e.VersionId)] = e
+	}
+
+	var unchanged []object
+	check := func(objects []object) {
+		for _, obj := range objects {
+			id := versionKey(aws.ToString(obj.Key), aws.ToString(obj.VersionId))
+			e, ok := planned[id]
+			if !ok || e.Size != obj.Size || e.ETag != aws.ToString(obj.ETag) {
+				continue
+			}
+			delete(planned, id)
+			unchanged = append(unchanged, obj)
+		}
+	}
+	for _, prefix := range plan.Prefixes {
+		if err := scanPlanPrefix(ctx, p, prefix, plan.Versions, check); err != nil {
+			return err
+		}
+	}
+
+	if plan.Objects > 0 {
+		drift := float64(len(planned)) / float64(plan.Objects)
+		slog.Info("Checked plan against bucket", "planned", plan.Objects, "unchanged", len(unchanged), "drifted", len(planned), "snapshot", plan.Snapshot)
+		if drift > maxDrift {
+			return fmt.Errorf("%.2f%% of the planned objects have changed or disappeared since the plan was made (--maxDrift is %.2f%%), make a new plan",
+				drift*100, maxDrift*100)
+		}
+	}
+
+	for len(unchanged) > 0 {
+		n := min(keyPageSize, len(unchanged))
+		p.submit(ctx, unchanged[:n:n], false)
+		unchanged = unchanged[n:]
+	}
+	return nil
+}
+
+// scanPlanPrefix lists everything under a plan prefix, without filtering.
+func scanPlanPrefix(ctx context.Context, p *purger, prefix string, versions bool, fn func([]object)) error {
+	if !versions {
+		paginator := s3.NewListObjectsV2Paginator(p.svc, &s3.ListObjectsV2Input{
+			Bucket: &p.bucketName,
+			Prefix: aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			output, err := nextPage(ctx, p, paginator.NextPage)
+			if err != nil {
+				return fmt.Errorf("failed to list objects: %w", err)
+			}
+			fn(objectsFromListing(output.Contents))
+		}
+		return nil
+	}
+
+	paginator := s3.NewListObjectVersionsPaginator(p.svc, &s3.ListObjectVersionsInput{
+		Bucket: &p.bucketName,
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		output, err := nextPage(ctx, p, paginator.NextPage)
+		if err != nil {
+			return fmt.Errorf("failed to list object versions: %w", err)
+		}
+		page := make([]object, 0, len(output.Versions)+len(output.DeleteMarkers))
+		for _, v := range output.Versions {
+			page = append(page, objectFromVersion(v))
+		}
+		for _, m := range output.DeleteMarkers {
+			page = append(page, objectFromDeleteMarker(m))
+		}
+		fn(page)
+	}
+	return nil
+}
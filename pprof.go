@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof serves the runtime profiles under /debug/pprof/ on addr for the
+// rest of the process, so a long run can be profiled while it's going.
+// Listening happens up front so a bad address fails the run straight away.
+func servePprof(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on --pprofAddr: %w", err)
+	}
+
+	// The command line isn't served, since it holds --secretKey
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	slog.Info("Serving pprof", "url", fmt.Sprintf("http://%s/debug/pprof/", ln.Addr()))
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("pprof server stopped", "error", err)
+		}
+	}()
+	return nil
+}
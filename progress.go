@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// rateWindow measures the deletion rate over a sliding window, so a
+// throughput collapse late in a run shows up straight away rather than being
+// averaged away by the hours before it.
+type rateWindow struct {
+	window  time.Duration
+	samples []rateSample
+}
+
+type rateSample struct {
+	at      time.Time
+	deleted uint64
+}
+
+// add records the number of objects deleted so far, dropping samples that
+// have fallen out of the window. The newest sample at least a window old is
+// kept as the baseline.
+func (w *rateWindow) add(at time.Time, deleted uint64) {
+	w.samples = append(w.samples, rateSample{at: at, deleted: deleted})
+	cutoff := at.Add(-w.window)
+	i := 0
+	for i+1 < len(w.samples) && !w.samples[i+1].at.After(cutoff) {
+		i++
+	}
+	w.samples = w.samples[i:]
+}
+
+// rate returns the objects deleted per second over the window.
+func (w *rateWindow) rate() float64 {
+	first, last := w.samples[0], w.samples[len(w.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.deleted-first.deleted) / elapsed
+}
+
+// topPrefixes is how many prefixes with the most deletions the progress log
+// shows with --prefixStats.
+const topPrefixes = 5
+
+// logProgress logs the recent and average deletion rates every interval for
+// the rest of the run, along with the percentage done and an ETA when the
+// number of objects to delete is known (expected > 0).
+func logProgress(p *purger, start time.Time, interval, window time.Duration, expected uint64) {
+	w := &rateWindow{window: window}
+	w.add(start, 0)
+	go func() {
+		for {
+			time.Sleep(interval)
+			now := time.Now()
+			deleted := p.stats.deleted.Load()
+			w.add(now, deleted)
+			rate := w.rate()
+
+			// The rates are fields too, for --logFormat json
+			args := []any{
+				"rate", roundRate(rate),
+				"average", roundRate(float64(deleted) / now.Sub(start).Seconds()),
+				"concurrency", p.throttle.current(),
+			}
+			if expected > 0 {
+				args = append(args, "percent", percentDone(deleted, expected))
+			}
+			if expected > deleted && rate > 0 {
+				eta := time.Duration(float64(expected-deleted) / rate * float64(time.Second))
+				args = append(args, "remaining", expected-deleted, "eta", eta.Round(time.Second))
+			}
+			if p.stats.prefixes != nil {
+				args = append(args, "topPrefixes", p.stats.prefixes.top(topPrefixes))
+			}
+			slog.Info(fmt.Sprintf("Current deletion rate: %.3f items/second", rate), args...)
+		}
+	}()
+}
+
+// roundRate rounds a rate to the precision it's displayed with.
+func roundRate(rate float64) float64 {
+	return math.Round(rate*1000) / 1000
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// promptTTY asks the operator a question on the controlling terminal and
+// returns the trimmed answer. The terminal is used rather than stdin so that
+// prompts keep working when stdin carries keys for --keysFrom -.
+func promptTTY(question string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no terminal is available to prompt on: %w", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, question)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read answer: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// confirmPurge makes the operator type the bucket name before anything is
+// deleted, so a purge can't be pointed at the wrong bucket by accident.
+func confirmPurge(bucketName, endpoint string) error {
+	answer, err := promptTTY(fmt.Sprintf("This will delete objects from bucket %s at %s.\nType the bucket name to continue: ", bucketName, endpoint))
+	if err != nil {
+		return fmt.Errorf("confirmation is required, pass --yes to skip it: %w", err)
+	}
+	if answer != bucketName {
+		return fmt.Errorf("bucket name not confirmed, nothing was deleted")
+	}
+	return nil
+}
+
+// confirmCanary asks whether to continue at full concurrency once the
+// canary batch has been deleted.
+func confirmCanary(deleted uint64, total int) error {
+	answer, err := promptTTY(fmt.Sprintf("Canary batch deleted %d of %d objects. Continue at full concurrency? [y/N]: ", deleted, total))
+	if err != nil {
+		return fmt.Errorf("canary confirmation is required, pass --canaryDelay or --yes to skip it: %w", err)
+	}
+	if answer = strings.ToLower(answer); answer != "y" && answer != "yes" {
+		return fmt.Errorf("stopped after the canary batch")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// defaultProtectFile is consulted when --protectFile isn't given, so that an
+// organization-wide denylist can be installed alongside the binary.
+const defaultProtectFile = "/etc/s3purge/protected-buckets"
+
+// checkProtected refuses to operate on a bucket matched by a --protect
+// pattern or by a line of the protect file. Patterns use path.Match syntax,
+// e.g. prod-*.
+func checkProtected(c *cli.Context, bucketName string) error {
+	patterns := c.StringSlice("protect")
+
+	protectPath := c.String("protectFile")
+	if protectPath == "" {
+		if _, err := os.Stat(defaultProtectFile); err == nil {
+			protectPath = defaultProtectFile
+		}
+	}
+	if protectPath != "" {
+		loaded, err := loadProtectFile(protectPath)
+		if err != nil {
+			return err
+		}
+		slog.Debug("loaded protect file", "path", protectPath, "patterns", len(loaded))
+		patterns = append(patterns, loaded...)
+	}
+
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, bucketName)
+		if err != nil {
+			return fmt.Errorf("invalid protected bucket pattern %q: %w", pattern, err)
+		}
+		if matched {
+			return fmt.Errorf("bucket %s is protected by pattern %q, refusing to touch it", bucketName, pattern)
+		}
+	}
+	return nil
+}
+
+// loadProtectFile reads bucket name patterns, one per line, skipping blank
+// lines and # comments.
+func loadProtectFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open protect file: %w", err)
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read protect file: %w", err)
+	}
+	return patterns, nil
+}
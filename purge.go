@@ -0,0 +1,664 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// purger filters candidate objects, groups them into batches and deletes the
+// batches concurrently. Candidates may come from a bucket listing or from an
+// external source such as a key file, and submit may be called from several
+// listing goroutines at once.
+type purger struct {
+	svc        *s3.Client
+	bucketName string
+	filter     *objectFilter
+	lookups    *lookupFilter
+	stats      *purgeStats
+
+	// A fixed pool of workers deletes the batches sent on queue. wg
+	// counts batches from when they're sent until they and any retries
+	// are done.
+	queue       chan deleteBatch
+	workers     sync.WaitGroup
+	concurrency int
+	wg          sync.WaitGroup
+	throttle    *throttle
+	// Shared object rate limit (--maxRate), or nil
+	objectLimiter *rate.Limiter
+
+	skipped      atomic.Uint64
+	lookupErrors atomic.Uint64
+	listPages    atomic.Uint64
+	// The last key listed by each listing still in progress, for
+	// --statusAddr
+	listing listingPositions
+	// Objects that were already gone by the time they were deleted
+	alreadyGone atomic.Uint64
+
+	// Matching objects left alone because of their archive state, or
+	// because they were modified too recently
+	archived  atomic.Uint64
+	restoring atomic.Uint64
+	recent    atomic.Uint64
+
+	// mu guards the batching state below
+	mu      sync.Mutex
+	objects []object // This slice will accumulate objects to delete in a batch
+	queued  uint64
+
+	// Stop queueing once this many objects have been queued (0 is unlimited)
+	maxObjects uint64
+	// Abort if more than this many objects match (0 is unlimited)
+	maxDelete uint64
+
+	// Delete the first canary objects on their own, then wait for
+	// confirmation (or canaryDelay) before continuing
+	canary        int
+	canaryDelay   time.Duration
+	canaryConfirm bool
+	canaryDone    bool
+
+	// Abort once this many batches have failed, or this fraction of them
+	// (0 is unlimited). Set through an atomic rather than mu, since batches
+	// finish while a flush may be holding mu.
+	maxErrors     uint64
+	maxErrorRate  float64
+	batches       atomic.Uint64
+	failedBatches atomic.Uint64
+	abortErr      atomic.Pointer[error]
+	// Level at which each deleted key is logged
+	deletedLogLevel slog.Level
+
+	// Only report what would be deleted, optionally recording it in a
+	// manifest, plan or summary
+	dryRun   bool
+	manifest *manifestWriter
+	plan     *planRecorder
+	summary  *prefixSummary
+
+	// MFA header source for buckets with MFA Delete enabled, or nil
+	mfa *mfaProvider
+	// Delete versions protected by governance-mode Object Lock
+	bypassGovernance bool
+	// Objects that couldn't be deleted because of Object Lock, or for any
+	// other reason
+	locks    *lockReport
+	failures *failureReport
+	// Retry objects failing with retryable errors this many times, backing
+	// off exponentially from retryBase
+	retries   int
+	retryBase time.Duration
+	// Retry a failing listing page this many times
+	listRetries int
+	// Lift legal holds on locked objects and retry them
+	removeLegalHolds bool
+
+	// Sources list every version rather than just current objects, and hold
+	// back the newest keepVersions version records of each key
+	versioned    bool
+	keepVersions int
+	// Only delete markers of keys with no versions left are submitted
+	orphanMarkers bool
+
+	// Directory markers are held back until all other objects are deleted
+	// when deferMarkers is set (--directoryMarkers last)
+	deferMarkers bool
+	markers      []object
+
+	// Listing positions are saved here for --resume, or nil
+	checkpoint *checkpointer
+	// Every deleted object is recorded here, or nil
+	audit *auditLog
+
+	// Set once the provider turns out not to support DeleteObjects, after
+	// which batches are deleted one object at a time
+	singleDeletes atomic.Bool
+	// Objects per DeleteObjects call (--batchSize), and the smaller size
+	// the provider accepts once it has rejected that (0 until then)
+	batchSize int
+	maxBatch  atomic.Int64
+}
+
+func newPurger(c *cli.Context, svc *s3.Client, bucketName string, filter *objectFilter, lookups *lookupFilter) *purger {
+	// Already validated at startup
+	concurrency, auto, _ := parseConcurrency(c.String("concurrency"))
+	batchSize, _ := parseBatchSize(c)
+	maxMemory, _ := parseMaxMemory(c)
+	concurrency = memoryConcurrency(maxMemory, batchSize, concurrency)
+
+	p := &purger{
+		svc:         svc,
+		bucketName:  bucketName,
+		filter:      filter,
+		lookups:     lookups,
+		stats:       &purgeStats{},
+		queue:       make(chan deleteBatch),
+		concurrency: concurrency,
+		throttle:    newThrottle(concurrency, auto),
+
+		batchSize:     batchSize,
+		objectLimiter: newObjectLimiter(c.Float64("maxRate"), batchSize),
+		maxObjects:    c.Uint64("maxObjects"),
+		maxDelete:     c.Uint64("maxDelete"),
+
+		canary:        c.Int("canary"),
+		canaryDelay:   c.Duration("canaryDelay"),
+		canaryConfirm: !c.Bool("yes"),
+
+		maxErrors:    c.Uint64("maxErrors"),
+		maxErrorRate: c.Float64("maxErrorRate"),
+
+		deletedLogLevel: slog.LevelDebug,
+		dryRun:          c.Bool("dryRun") || counting(c) || c.String("planOut") != "",
+		versioned:       listsVersions(c),
+		keepVersions:    c.Int("keepVersions"),
+		orphanMarkers:   c.Bool("orphanMarkersOnly"),
+		deferMarkers:    c.String("directoryMarkers") == "last",
+
+		bypassGovernance: c.Bool("bypassGovernance"),
+		locks:            &lockReport{svc: svc, bucketName: bucketName},
+		failures:         &failureReport{},
+		retries:          c.Int("retries"),
+		retryBase:        c.Duration("retryBackoff"),
+		listRetries:      c.Int("listRetries"),
+		removeLegalHolds: c.Bool("removeLegalHolds"),
+	}
+
+	if depth := c.Int("prefixStats"); depth > 0 {
+		p.stats.prefixes = newPrefixSummary(filter.prefix, depth)
+	}
+
+	// --head is a preview run, so show exactly what was deleted
+	if head := c.Uint64("head"); head > 0 {
+		if p.maxObjects == 0 || head < p.maxObjects {
+			p.maxObjects = head
+		}
+		p.deletedLogLevel = slog.LevelInfo
+	}
+	p.startWorkers()
+	return p
+}
+
+// listsVersions reports whether the flags select a version-aware purge, in
+// which case individual versions and delete markers are deleted.
+func listsVersions(c *cli.Context) bool {
+	return c.String("mode") == "permanent" || c.Bool("allVersions") || c.Bool("deleteBucket") || c.Bool("deleteMarkersOnly") || c.Bool("noncurrentOnly") ||
+		c.Bool("orphanMarkersOnly") || c.Int("keepVersions") > 0 || c.String("noncurrentOlderThan") != ""
+}
+
+// done reports whether the purger has stopped accepting objects, in which
+// case sources should stop producing them.
+func (p *purger) done() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.doneLocked()
+}
+
+func (p *purger) doneLocked() bool {
+	return p.aborted() != nil || (p.maxObjects > 0 && p.queued >= p.maxObjects)
+}
+
+// minErrorRateBatches is how many batches must have finished before
+// --maxErrorRate is enforced, so one early failure can't abort the run.
+const minErrorRateBatches = 20
+
+// aborted returns the reason the run was aborted, or nil.
+func (p *purger) aborted() error {
+	if err := p.abortErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// recordBatch accounts for a finished batch and aborts the run once too
+// many batches have failed. A batch that's being retried isn't finished, it
+// only counts as failed once it has run out of retries.
+func (p *purger) recordBatch(failed bool) {
+	batches := p.batches.Add(1)
+	if !failed {
+		return
+	}
+	failures := p.failedBatches.Add(1)
+
+	var err error
+	if p.maxErrors > 0 && failures >= p.maxErrors {
+		err = fmt.Errorf("aborted after %d failed batches (--maxErrors)", failures)
+	} else if rate := float64(failures) / float64(batches); p.maxErrorRate > 0 && batches >= minErrorRateBatches && rate > p.maxErrorRate {
+		err = fmt.Errorf("aborted after %d of %d batches failed (--maxErrorRate)", failures, batches)
+	}
+	if err != nil {
+		p.abort(thresholdError{err})
+	}
+}
+
+// abort stops the run, keeping the first reason given.
+func (p *purger) abort(err error) {
+	if p.abortErr.CompareAndSwap(nil, &err) {
+		slog.Error("Aborting run", "error", err)
+	}
+}
+
+// submit filters a group of candidates (usually one listing page) and queues
+// the survivors for deletion. keyOnly candidates carry no listing metadata
+// (see objectFilter.match).
+func (p *purger) submit(ctx context.Context, candidates []object, keyOnly bool) {
+	if p.done() {
+		return
+	}
+
+	// Sources hand their pages over, so they're filtered in place
+	matched := candidates[:0]
+	for _, item := range candidates {
+		key := aws.ToString(item.Key)
+		if !p.filter.match(item, keyOnly) {
+			slog.Debug("skipping object", "key", key)
+			p.skipped.Add(1)
+			continue
+		}
+		if !keyOnly {
+			if p.filter.tooRecent(item) {
+				slog.Debug("skipping recently modified object", "key", key, "lastModified", aws.ToTime(item.LastModified))
+				p.recent.Add(1)
+				continue
+			}
+			switch p.filter.archiveState(item) {
+			case "restoring":
+				slog.Debug("skipping object with restore in progress", "key", key, "storageClass", item.StorageClass)
+				p.restoring.Add(1)
+				continue
+			case "archived":
+				slog.Debug("skipping archived object", "key", key, "storageClass", item.StorageClass)
+				p.archived.Add(1)
+				continue
+			}
+		}
+		matched = append(matched, item)
+	}
+
+	// Key files carry no modification time, so --safetyMinAge has to look
+	// it up
+	if keyOnly && !p.filter.safetyCutoff.IsZero() && len(matched) > 0 {
+		dated, errs := p.lookups.dateKeys(ctx, matched)
+		p.lookupErrors.Add(uint64(errs))
+		matched = dated[:0]
+		for _, item := range dated {
+			if p.filter.tooRecent(item) {
+				slog.Debug("skipping recently modified object", "key", aws.ToString(item.Key), "lastModified", aws.ToTime(item.LastModified))
+				p.recent.Add(1)
+				continue
+			}
+			matched = append(matched, item)
+		}
+	}
+
+	// Narrow the candidates further with per-object lookups if needed
+	if p.lookups.enabled() && len(matched) > 0 {
+		found, errs := p.lookups.filter(ctx, matched)
+		p.skipped.Add(uint64(len(matched) - len(found) - errs))
+		p.lookupErrors.Add(uint64(errs))
+		matched = found
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, item := range matched {
+		if p.doneLocked() {
+			return
+		}
+		if p.maxDelete > 0 && p.queued >= p.maxDelete {
+			// Drop the unsent batch too, the selection is probably wrong
+			p.abort(fmt.Errorf("more than %d objects matched (--maxDelete), check the filters", p.maxDelete))
+			p.objects = nil
+			return
+		}
+		p.queued++
+		if p.deferMarkers && isDirectoryMarker(item, keyOnly) {
+			p.markers = append(p.markers, item)
+			continue
+		}
+		if p.objects == nil {
+			p.objects = newBatch(p.batchLimit())
+		}
+		p.objects = append(p.objects, item)
+
+		// If we have reached the batch size, delete these objects as a batch
+		if len(p.objects) >= p.batchLimitLocked() {
+			p.flushLocked()
+		}
+	}
+}
+
+// flush dispatches any accumulated objects as a (possibly partial) batch.
+func (p *purger) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flushLocked()
+}
+
+func (p *purger) flushLocked() {
+	if len(p.objects) == 0 {
+		return
+	}
+	if err := p.aborted(); err != nil {
+		// A run stopped by a signal or its deadline still deletes what it
+		// has queued, as does any run with a checkpoint, whose positions
+		// already count these objects as dealt with
+		if errors.Is(err, errInterrupted) || errors.Is(err, errDeadline) || p.checkpoint != nil {
+			p.send(p.objects, 1)
+		}
+		p.objects = nil
+		return
+	}
+	if p.canaryPendingLocked() {
+		p.runCanaryLocked()
+		return
+	}
+	p.send(p.objects, 1) // Blocks until a worker is free
+	p.objects = nil      // Reset the slice for the next batch
+}
+
+// wait flushes the final batch and waits for all deletions to complete,
+// then deletes any deferred directory markers as a final pass. Sources must
+// have stopped submitting.
+func (p *purger) wait() {
+	p.mu.Lock()
+	// The source ran dry before the canary batch filled up, so there's
+	// nothing left to confirm
+	p.canaryDone = true
+	p.mu.Unlock()
+
+	p.flush()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Markers are kept after an abort so a checkpoint can save them
+	if len(p.markers) == 0 || p.aborted() != nil {
+		return
+	}
+	slog.Info("Deleting directory markers", "count", len(p.markers))
+	for len(p.markers) > 0 {
+		n := min(p.batchLimit(), len(p.markers))
+		p.objects = p.markers[:n:n]
+		p.markers = p.markers[n:]
+		p.flushLocked()
+	}
+	p.wg.Wait()
+}
+
+// batchLimitLocked is the size at which the accumulated objects are sent,
+// which is smaller for the canary batch.
+func (p *purger) batchLimitLocked() int {
+	if p.canaryPendingLocked() {
+		return p.canary
+	}
+	return p.batchLimit()
+}
+
+// canaryPendingLocked reports whether the next batch is the canary. Dry runs
+// have nothing to be careful about.
+func (p *purger) canaryPendingLocked() bool {
+	return p.canary > 0 && !p.canaryDone && !p.dryRun
+}
+
+// runCanaryLocked deletes the canary batch on its own, shows what was
+// deleted and holds every source (which block on mu) until the operator
+// confirms or the canary delay has passed.
+func (p *purger) runCanaryLocked() {
+	p.canaryDone = true
+	batch := p.objects
+	p.objects = nil
+
+	slog.Info("Deleting canary batch", "count", len(batch))
+	level := p.deletedLogLevel
+	p.deletedLogLevel = slog.LevelInfo
+	p.wg.Add(1)
+	p.deleteObjects(batch, 1)
+	p.wg.Wait() // Including any retries
+	p.deletedLogLevel = level
+
+	deleted := p.stats.deleted.Load()
+	switch {
+	case p.canaryDelay > 0:
+		slog.Info(fmt.Sprintf("Canary batch deleted %d of %d objects, continuing at full concurrency in %s", deleted, len(batch), p.canaryDelay))
+		time.Sleep(p.canaryDelay)
+	case p.canaryConfirm:
+		if err := confirmCanary(deleted, len(batch)); err != nil {
+			p.abort(err)
+		}
+	}
+}
+
+// mfaAttempts bounds how many times a batch is retried with a fresh MFA
+// token before giving up on it.
+const mfaAttempts = 3
+
+// deleteObjects deletes a batch of objects. attempt counts from 1, and
+// objects that fail with a retryable error are retried after a backoff up to
+// --retries times before being given up on.
+func (p *purger) deleteObjects(objects []object, attempt int) {
+	defer p.wg.Done()
+	ctx, span := tracer.Start(context.Background(), "deleteBatch", trace.WithAttributes(
+		attribute.Int("s3purge.objects", len(objects)),
+		attribute.Int("s3purge.attempt", attempt),
+	))
+	defer span.End()
+
+	if p.dryRun {
+		for _, obj := range objects {
+			slog.Log(context.TODO(), p.deletedLogLevel, "would delete object", "key", aws.ToString(obj.Key), "versionId", aws.ToString(obj.VersionId), "size", obj.Size)
+		}
+		if p.manifest != nil {
+			if err := p.manifest.write(objects); err != nil {
+				slog.Error("failed to record objects in manifest", "error", err)
+			}
+		}
+		if p.plan != nil {
+			p.plan.record(objects)
+		}
+		if p.summary != nil {
+			p.summary.record(objects)
+		}
+		p.stats.recordDeleted(objects)
+		releaseBatch(objects)
+		return
+	}
+
+	if p.singleDeletes.Load() {
+		if p.objectLimiter != nil {
+			p.objectLimiter.WaitN(ctx, len(objects))
+		}
+		deleted, retry := p.deleteEach(ctx, objects, attempt)
+		p.finishBatch(deleted, retry, attempt)
+		releaseBatch(objects)
+		return
+	}
+
+	input := &s3.DeleteObjectsInput{
+		Bucket:                    &p.bucketName,
+		BypassGovernanceRetention: p.bypassGovernance,
+		Delete: &types.Delete{
+			// Only errors are needed back, objects not listed as failed
+			// were deleted
+			Quiet:   true,
+			Objects: identifiersFor(objects),
+		},
+	}
+
+	var output *s3.DeleteObjectsOutput
+	var err error
+	for mfaAttempt := 1; ; mfaAttempt++ {
+		var generation int
+		if p.mfa != nil {
+			var header string
+			header, generation = p.mfa.header()
+			input.MFA = &header
+		}
+		if p.objectLimiter != nil && mfaAttempt == 1 {
+			p.objectLimiter.WaitN(ctx, len(objects))
+		}
+		p.throttle.acquire()
+		// Separates waiting for the throttle from the call itself
+		span.AddEvent("throttle acquired")
+		output, err = p.svc.DeleteObjects(ctx, input)
+		var keyErrors []types.Error
+		if output != nil {
+			keyErrors = output.Errors
+		}
+		p.throttle.release(slowDown(err, keyErrors))
+		if err == nil || p.mfa == nil || !isMFAError(err) || mfaAttempt == mfaAttempts {
+			break
+		}
+		if refreshErr := p.mfa.refresh(generation); refreshErr != nil {
+			slog.Error("failed to refresh MFA token", "error", refreshErr)
+			break
+		}
+	}
+	unsupported := multiDeleteUnsupported(err)
+	if err != nil && errorCode(err) == "MalformedXML" {
+		output, unsupported, err = p.confirmMultiDeleteUnsupported(ctx, input)
+	}
+	releaseIdentifiers(input.Delete.Objects)
+
+	if err != nil && len(objects) > 1 && batchTooLarge(err) {
+		p.splitBatch(objects, attempt)
+		return
+	}
+	if unsupported {
+		p.fallBackToSingleDeletes(err)
+		deleted, retry := p.deleteEach(ctx, objects, attempt)
+		p.finishBatch(deleted, retry, attempt)
+		releaseBatch(objects)
+		return
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, errorCode(err))
+		if code := errorCode(err); p.canRetry(code, attempt) {
+			slog.Warn("failed to delete objects, will retry", "count", len(objects), "attempt", attempt, "error", err)
+			p.retryLater(objects, attempt)
+			return
+		}
+		p.recordBatch(true)
+		keys := make([]string, len(objects))
+		for i := range objects {
+			keys[i] = aws.ToString(objects[i].Key)
+		}
+		slog.Error("failed to delete objects", "keys", keys, "attempts", attempt, "error", err)
+		p.failures.record(objects, errorCode(err), err.Error())
+		releaseBatch(objects)
+		return
+	}
+	p.recordBatch(false)
+
+	// The call can succeed while individual keys fail
+	deleted, retry := objects, []object(nil)
+	if len(output.Errors) > 0 {
+		span.SetAttributes(attribute.Int("s3purge.keyErrors", len(output.Errors)))
+		deleted, retry = p.handleKeyErrors(objects, output.Errors, attempt, output.ResultMetadata)
+	} else {
+		p.recordAudit(objects, output.ResultMetadata)
+	}
+	p.finishBatch(deleted, retry, attempt)
+	releaseBatch(objects)
+}
+
+// finishBatch schedules the retries of a batch and accounts for the objects
+// that were deleted.
+func (p *purger) finishBatch(deleted, retry []object, attempt int) {
+	if len(retry) > 0 {
+		slog.Warn("some objects failed to delete, will retry", "count", len(retry), "attempt", attempt)
+		p.retryLater(retry, attempt)
+	}
+	// Building the attributes allocates, so skip it unless they're logged
+	if slog.Default().Enabled(context.TODO(), p.deletedLogLevel) {
+		for _, obj := range deleted {
+			slog.Log(context.TODO(), p.deletedLogLevel, "deleted object", "key", aws.ToString(obj.Key), "versionId", aws.ToString(obj.VersionId), "size", obj.Size)
+		}
+	}
+	p.stats.recordDeleted(deleted)
+}
+
+// handleKeyErrors deals with the per-key errors of a DeleteObjects call and
+// returns the objects that were actually deleted, so that failed keys are
+// never counted as deleted, along with those to retry. Objects protected by
+// Object Lock have their legal hold lifted if requested, or are otherwise
+// recorded for the lock report; other failures are tallied by error code.
+// metadata is that of the response the errors came in, for the audit log.
+func (p *purger) handleKeyErrors(objects []object, keyErrors []types.Error, attempt int, metadata middleware.Metadata) (deleted, retry []object) {
+	failed := make(map[string]types.Error, len(keyErrors))
+	for _, e := range keyErrors {
+		failed[versionKey(aws.ToString(e.Key), aws.ToString(e.VersionId))] = e
+	}
+
+	// Objects with a legal hold lifted are deleted, and audited, separately
+	var audited []object
+	defer func() { p.recordAudit(audited, metadata) }()
+
+	deleted = objects[:0:0]
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		e, ok := failed[versionKey(key, aws.ToString(obj.VersionId))]
+		if !ok {
+			// Some providers don't echo the version ID back
+			e, ok = failed[versionKey(key, "")]
+		}
+		if !ok {
+			deleted = append(deleted, obj)
+			audited = append(audited, obj)
+			continue
+		}
+		if alreadyDeleted(aws.ToString(e.Code)) {
+			// Deleted by an earlier run or by someone else, which is what
+			// a re-run of a partially completed purge expects
+			slog.Debug("object already deleted", "key", key, "versionId", aws.ToString(obj.VersionId))
+			p.alreadyGone.Add(1)
+			continue
+		}
+		if isObjectLockError(e) {
+			if p.removeLegalHolds && p.releaseLegalHold(context.TODO(), obj) {
+				deleted = append(deleted, obj)
+				continue
+			}
+			p.locks.record(context.TODO(), obj)
+			p.failures.recordLocked(obj)
+			continue
+		}
+		if p.canRetry(aws.ToString(e.Code), attempt) {
+			retry = append(retry, obj)
+			continue
+		}
+		slog.Error("failed to delete object", "key", key, "versionId", aws.ToString(obj.VersionId),
+			"code", aws.ToString(e.Code), "error", aws.ToString(e.Message))
+		p.failures.record([]object{obj}, aws.ToString(e.Code), aws.ToString(e.Message))
+	}
+	return deleted, retry
+}
+
+// alreadyDeleted reports whether a per-key error code means the object (or
+// version) no longer exists. S3 itself reports success for missing keys,
+// but some providers don't.
+func alreadyDeleted(code string) bool {
+	return code == "NoSuchKey" || code == "NoSuchVersion"
+}
+
+// versionKey identifies a key or a specific version of it.
+func versionKey(key, versionId string) string {
+	return key + "\x00" + versionId
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedClient holds every HTTP request the SDK makes, including its
+// own retries, to a shared request rate (--maxRps).
+type rateLimitedClient struct {
+	aws.HTTPClient
+	limiter *rate.Limiter
+}
+
+func (c *rateLimitedClient) Do(req *http.Request) (*http.Response, error) {
+	if err := c.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return c.HTTPClient.Do(req)
+}
+
+// newObjectLimiter returns a limiter for the number of objects deleted per
+// second (--maxRate), or nil if unlimited. The burst must fit a whole batch.
+func newObjectLimiter(perSecond float64, batchSize int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), max(batchSize, int(perSecond)))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// runResult is the outcome of a run, written by --summaryOut so pipelines
+// and runbooks can assert on it.
+type runResult struct {
+	// completed, failed, interrupted or deadline
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	DryRun   bool   `json:"dryRun"`
+
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	AverageRate     float64   `json:"averageRate"`
+
+	Deleted        uint64            `json:"deleted"`
+	Bytes          uint64            `json:"bytes"`
+	Skipped        uint64            `json:"skipped"`
+	AlreadyDeleted uint64            `json:"alreadyDeleted"`
+	LookupErrors   uint64            `json:"lookupErrors"`
+	Locked         int               `json:"locked"`
+	Failed         uint64            `json:"failed"`
+	FailedBatches  uint64            `json:"failedBatches"`
+	FailuresByCode map[string]uint64 `json:"failuresByCode"`
+
+	Flags map[string]string `json:"flags"`
+}
+
+// newRunResult summarizes a run that started at started and ended with err
+// (nil if it completed).
+func newRunResult(c *cli.Context, p *purger, started time.Time, err error) *runResult {
+	finished := time.Now()
+	r := &runResult{
+		Status:   "completed",
+		Endpoint: endpointNames(c),
+		Bucket:   c.String("bucket"),
+		DryRun:   p.dryRun,
+
+		Started:         started.UTC(),
+		Finished:        finished.UTC(),
+		DurationSeconds: finished.Sub(started).Seconds(),
+		AverageRate:     roundRate(float64(p.stats.deleted.Load()) / finished.Sub(started).Seconds()),
+
+		Deleted:        p.stats.deleted.Load(),
+		Bytes:          p.stats.bytes.Load(),
+		Skipped:        p.skipped.Load(),
+		AlreadyDeleted: p.alreadyGone.Load(),
+		LookupErrors:   p.lookupErrors.Load(),
+		Locked:         p.locks.total(),
+		Failed:         p.failures.total(),
+		FailedBatches:  p.failedBatches.Load(),
+		FailuresByCode: make(map[string]uint64),
+
+		Flags: setFlags(c),
+	}
+	for _, f := range p.failures.byCode() {
+		r.FailuresByCode[f.code] = f.count
+	}
+	if err != nil {
+		r.Error = err.Error()
+		switch {
+		case errors.Is(err, errInterrupted):
+			r.Status = "interrupted"
+		case errors.Is(err, errDeadline):
+			r.Status = "deadline"
+		default:
+			r.Status = "failed"
+		}
+	}
+	return r
+}
+
+// write saves the result as JSON.
+func (r *runResult) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run summary: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write run summary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// retryableCodes are error codes worth retrying later: the provider is
+// overloaded or hit an internal problem, rather than refusing the request.
+var retryableCodes = map[string]bool{
+	"InternalError":       true,
+	"ServiceUnavailable":  true,
+	"SlowDown":            true,
+	"RequestTimeout":      true,
+	"OperationAborted":    true,
+	"Throttling":          true,
+	"ThrottlingException": true,
+	"RequestFailed":       true, // No response at all, see errorCode
+}
+
+// maxRetryBackoff caps the delay between retries of a batch.
+const maxRetryBackoff = time.Minute
+
+// retryBackoff returns how long to wait before the given retry (1 for the
+// first) of a batch: exponential in the attempt, with jitter so batches that
+// failed together don't all retry at once.
+func (p *purger) retryBackoff(retry int) time.Duration {
+	d := p.retryBase << (retry - 1)
+	if d <= 0 || d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	// Pick uniformly from [d/2, d)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// canRetry reports whether objects failing with the code on the given
+// attempt (1 for the first) should be retried.
+func (p *purger) canRetry(code string, attempt int) bool {
+	return attempt <= p.retries && retryableCodes[code] && p.aborted() == nil
+}
+
+// retryLater sends the objects to the workers again after a backoff, as a
+// batch of their own. The retry is counted in wg from the start, so wait
+// covers pending retries.
+func (p *purger) retryLater(objects []object, attempt int) {
+	p.wg.Add(1)
+	time.AfterFunc(p.retryBackoff(attempt), func() {
+		defer p.wg.Done()
+		p.send(objects, attempt+1)
+	})
+}
+
+// nextPage fetches the next page of a listing, retrying transient failures
+// after a backoff up to --listRetries times. Paginators only advance on
+// success, so a retry asks for the same page again.
+func nextPage[T any](ctx context.Context, p *purger, next func(context.Context, ...func(*s3.Options)) (T, error)) (T, error) {
+	ctx, span := tracer.Start(ctx, "listPage")
+	defer span.End()
+	for retry := 1; ; retry++ {
+		output, err := next(ctx)
+		if err == nil {
+			p.listPages.Add(1)
+			return output, nil
+		}
+		code := errorCode(err)
+		if retry > p.listRetries || p.aborted() != nil || (!retryableCodes[code] && !throttlingCodes[code]) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, code)
+			return output, err
+		}
+		delay := p.retryBackoff(retry)
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("code", code), attribute.Int64("delayMs", delay.Milliseconds())))
+		slog.Warn("failed to list page, will retry", "attempt", retry, "delay", delay, "error", err)
+		time.Sleep(delay)
+	}
+}
+
+// newSDKRetryer builds the retryer the SDK uses for each request, before
+// s3purge's own retry queue gets involved. Zero maxAttempts or maxBackoff
+// keep the SDK defaults.
+func newSDKRetryer(mode string, maxAttempts int, maxBackoff time.Duration) (func() aws.Retryer, error) {
+	standard := func(o *retry.StandardOptions) {
+		if maxAttempts > 0 {
+			o.MaxAttempts = maxAttempts
+		}
+		if maxBackoff > 0 {
+			o.MaxBackoff = maxBackoff
+		}
+	}
+	switch mode {
+	case "standard":
+		return func() aws.Retryer {
+			return retry.NewStandard(standard)
+		}, nil
+	case "adaptive":
+		return func() aws.Retryer {
+			return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+				o.StandardOptions = append(o.StandardOptions, standard)
+			})
+		}, nil
+	}
+	return nil, fmt.Errorf("--sdkRetryMode must be standard or adaptive")
+}
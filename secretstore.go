@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// secretsManagerRefresh is how often a key pair from Secrets Manager is
+// fetched again, so a rotation during a long run is picked up.
+const secretsManagerRefresh = 15 * time.Minute
+
+// secretStoreCredentials returns credentials fetched from a secret store for
+// --credentialsFrom: vault:<path> for a HashiCorp Vault secret, or a Secrets
+// Manager secret's ARN. They're fetched again as they expire. cfg holds the
+// HTTP client both are reached with, and the base credentials Secrets
+// Manager is called with.
+func secretStoreCredentials(from string, cfg aws.Config) (aws.CredentialsProvider, error) {
+	if path, ok := strings.CutPrefix(from, "vault:"); ok {
+		return aws.NewCredentialsCache(&vaultCredentials{client: cfg.HTTPClient, path: strings.Trim(path, "/")}), nil
+	}
+	parsed, err := arn.Parse(from)
+	if err != nil || parsed.Service != "secretsmanager" {
+		return nil, fmt.Errorf("--credentialsFrom must be vault:<path> or the ARN of a Secrets Manager secret")
+	}
+	smCfg := cfg.Copy()
+	smCfg.Region = parsed.Region
+	return aws.NewCredentialsCache(&secretsManagerCredentials{client: secretsmanager.NewFromConfig(smCfg), arn: from}), nil
+}
+
+// storedKeys is a key pair as kept in a secret. The field names of Vault's
+// AWS secrets engine are used, and those of the AWS CLI's config also
+// accepted.
+type storedKeys struct {
+	AccessKey     string `json:"access_key"`
+	SecretKey     string `json:"secret_key"`
+	SecurityToken string `json:"security_token"`
+
+	AccessKeyID     string `json:"aws_access_key_id"`
+	SecretAccessKey string `json:"aws_secret_access_key"`
+	SessionToken    string `json:"aws_session_token"`
+}
+
+func (k *storedKeys) credentials(source string) (aws.Credentials, error) {
+	creds := aws.Credentials{
+		AccessKeyID:     k.AccessKey,
+		SecretAccessKey: k.SecretKey,
+		SessionToken:    k.SecurityToken,
+		Source:          source,
+	}
+	if creds.AccessKeyID == "" {
+		creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken = k.AccessKeyID, k.SecretAccessKey, k.SessionToken
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return aws.Credentials{}, fmt.Errorf("the secret has no access_key and secret_key")
+	}
+	return creds, nil
+}
+
+// vaultCredentials reads a key pair from a Vault secret: a KV secret, or
+// the dynamic credentials of the AWS secrets engine, which expire with
+// their lease. The Vault server and token come from VAULT_ADDR and
+// VAULT_TOKEN (or ~/.vault-token) as for the vault CLI, along with
+// VAULT_NAMESPACE.
+type vaultCredentials struct {
+	client aws.HTTPClient
+	path   string
+}
+
+func (v *vaultCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return aws.Credentials{}, fmt.Errorf("VAULT_ADDR must be set to read credentials from Vault")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			data, _ := os.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(data))
+		}
+	}
+	if token == "" {
+		return aws.Credentials{}, fmt.Errorf("VAULT_TOKEN must be set to read credentials from Vault")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+v.path, nil)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials from Vault: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials from Vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials from Vault: %s", resp.Status)
+	}
+
+	var secret struct {
+		LeaseDuration int             `json:"lease_duration"`
+		Data          json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials from Vault: %w", err)
+	}
+	// KV version 2 secrets nest their data once more
+	var kv2 struct {
+		Data     *storedKeys     `json:"data"`
+		Metadata json.RawMessage `json:"metadata"`
+	}
+	var keys storedKeys
+	if json.Unmarshal(secret.Data, &kv2) == nil && kv2.Data != nil && kv2.Metadata != nil {
+		keys = *kv2.Data
+	} else if err := json.Unmarshal(secret.Data, &keys); err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials from Vault: %w", err)
+	}
+	creds, err := keys.credentials("Vault")
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials from Vault: %w", err)
+	}
+	if secret.LeaseDuration > 0 {
+		creds.CanExpire = true
+		creds.Expires = time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second)
+	}
+	return creds, nil
+}
+
+// secretsManagerCredentials reads a key pair from a Secrets Manager secret
+// holding it as JSON.
+type secretsManagerCredentials struct {
+	client *secretsmanager.Client
+	arn    string
+}
+
+func (s *secretsManagerCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	output, err := s.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: &s.arn})
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials from Secrets Manager: %w", err)
+	}
+	var keys storedKeys
+	if err := json.Unmarshal([]byte(aws.ToString(output.SecretString)), &keys); err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials from Secrets Manager: the secret isn't JSON")
+	}
+	creds, err := keys.credentials("SecretsManager")
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials from Secrets Manager: %w", err)
+	}
+	creds.CanExpire = true
+	creds.Expires = time.Now().Add(secretsManagerRefresh)
+	return creds, nil
+}
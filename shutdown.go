@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// errInterrupted aborts the purge when a signal arrives.
+	errInterrupted = errors.New("interrupted")
+	// errDeadline aborts the purge once --deadline or --runFor is reached.
+	errDeadline = errors.New("deadline reached")
+)
+
+// shutdown turns SIGINT and SIGTERM into a graceful stop: no new batches are
+// started, in-flight ones are allowed to finish and the run ends with the
+// usual summary. If that takes longer than the timeout, or a second signal
+// arrives, the registered cleanups run and the process exits immediately.
+type shutdown struct {
+	signals chan os.Signal
+
+	mu       sync.Mutex
+	cleanups []func()
+}
+
+func handleSignals(p *purger, timeout time.Duration) *shutdown {
+	s := &shutdown{signals: make(chan os.Signal, 2)}
+	signal.Notify(s.signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-s.signals
+		slog.Warn("Interrupted, waiting for in-flight batches to finish (interrupt again to exit now)", "signal", sig, "timeout", timeout)
+		p.abort(errInterrupted)
+
+		select {
+		case <-s.signals:
+			slog.Warn("Interrupted again, exiting now")
+		case <-time.After(timeout):
+			slog.Warn("Timed out waiting for in-flight batches, exiting now")
+		}
+		s.mu.Lock()
+		for _, cleanup := range s.cleanups {
+			cleanup()
+		}
+		s.mu.Unlock()
+		slog.Warn("Exited before the purge finished", "deleted", p.stats.deleted.Load(), "bytes", p.stats.bytes.Load())
+		os.Exit(exitInterrupted)
+	}()
+	return s
+}
+
+// interruptContext returns a context that SIGINT and SIGTERM cancel with
+// errInterrupted, for commands like bench that have no batches to drain and
+// just stop. A second signal exits immediately. stop releases the signals.
+func interruptContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Warn("Interrupted, cleaning up (interrupt again to exit now)", "signal", sig)
+			cancel(errInterrupted)
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			slog.Warn("Interrupted again, exiting now")
+			os.Exit(exitInterrupted)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel(nil)
+	}
+}
+
+// onExit registers a cleanup to run if the process has to exit without
+// finishing the graceful stop.
+func (s *shutdown) onExit(cleanup func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanups = append(s.cleanups, cleanup)
+}
+
+// stopAt stops the purge gracefully at the deadline, the same way as a
+// first signal. A zero deadline does nothing.
+func stopAt(p *purger, deadline time.Time) {
+	if deadline.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(deadline), func() {
+		slog.Warn("Reached the deadline, waiting for in-flight batches to finish", "deadline", deadline.Format(time.RFC3339))
+		p.abort(errDeadline)
+	})
+}
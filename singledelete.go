@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// singleDeleteConcurrency is how many DeleteObject calls each batch makes at
+// once when the provider doesn't support DeleteObjects. The throttle still
+// bounds the requests in flight across batches.
+const singleDeleteConcurrency = 16
+
+// multiDeleteUnsupported reports whether a DeleteObjects call failed because
+// the provider doesn't implement it. Some, like GCS's XML API and older
+// gateways, reject the request body as malformed instead, which a bad
+// request can cause too; see confirmMultiDeleteUnsupported.
+func multiDeleteUnsupported(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "NotImplemented", "MethodNotAllowed":
+		return true
+	}
+	return false
+}
+
+// confirmMultiDeleteUnsupported sends a DeleteObjects call that was rejected
+// as MalformedXML once more, and reports whether it's rejected the same way,
+// which is taken to mean the provider doesn't support DeleteObjects. The
+// second call's result stands in for the first.
+func (p *purger) confirmMultiDeleteUnsupported(ctx context.Context, input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, bool, error) {
+	slog.Warn("DeleteObjects was rejected as malformed, sending the batch again", "count", len(input.Delete.Objects))
+	p.throttle.acquire()
+	output, err := p.svc.DeleteObjects(ctx, input)
+	var keyErrors []types.Error
+	if output != nil {
+		keyErrors = output.Errors
+	}
+	p.throttle.release(slowDown(err, keyErrors))
+	return output, err != nil && errorCode(err) == "MalformedXML", err
+}
+
+// deleteEach deletes a batch with individual DeleteObject calls. Failures
+// are turned into the per-key errors DeleteObjects would have returned, so
+// they're retried and reported the same way. It returns the objects that
+// were deleted, along with those to retry.
+func (p *purger) deleteEach(ctx context.Context, objects []object, attempt int) (deleted, retry []object) {
+	var mu sync.Mutex
+	var keyErrors []types.Error
+	var succeeded, failed []object
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, singleDeleteConcurrency)
+	for _, obj := range objects {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(obj object) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			input := &s3.DeleteObjectInput{
+				Bucket:                    &p.bucketName,
+				Key:                       obj.Key,
+				VersionId:                 obj.VersionId,
+				BypassGovernanceRetention: p.bypassGovernance,
+			}
+			var output *s3.DeleteObjectOutput
+			var err error
+			// Retried with a fresh MFA token like a whole batch
+			for mfaAttempt := 1; ; mfaAttempt++ {
+				var generation int
+				if p.mfa != nil {
+					var header string
+					header, generation = p.mfa.header()
+					input.MFA = &header
+				}
+				p.throttle.acquire()
+				output, err = p.svc.DeleteObject(ctx, input)
+				p.throttle.release(slowDown(err, nil))
+				if err == nil || p.mfa == nil || !isMFAError(err) || mfaAttempt == mfaAttempts {
+					break
+				}
+				if refreshErr := p.mfa.refresh(generation); refreshErr != nil {
+					slog.Error("failed to refresh MFA token", "error", refreshErr)
+					break
+				}
+			}
+			if err == nil {
+				p.recordAudit([]object{obj}, output.ResultMetadata)
+				mu.Lock()
+				succeeded = append(succeeded, obj)
+				mu.Unlock()
+				return
+			}
+			e := types.Error{Key: obj.Key, VersionId: obj.VersionId, Code: aws.String(errorCode(err)), Message: aws.String(err.Error())}
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) {
+				e.Message = aws.String(apiErr.ErrorMessage())
+			}
+			mu.Lock()
+			keyErrors = append(keyErrors, e)
+			failed = append(failed, obj)
+			mu.Unlock()
+		}(obj)
+	}
+	wg.Wait()
+
+	n := 0
+	for _, e := range keyErrors {
+		if !alreadyDeleted(aws.ToString(e.Code)) {
+			n++
+		}
+	}
+	if len(keyErrors) == 0 {
+		p.recordBatch(false)
+		return objects, nil
+	}
+	// Only the failed objects are handled, the rest were deleted (and
+	// audited) one by one
+	deleted, retry = p.handleKeyErrors(failed, keyErrors, attempt, middleware.Metadata{})
+	if len(retry) == 0 {
+		p.recordBatch(n == len(objects))
+	}
+	return append(succeeded, deleted...), retry
+}
+
+// fallBackToSingleDeletes switches every later batch to DeleteObject calls,
+// logging the switch once.
+func (p *purger) fallBackToSingleDeletes(err error) {
+	if p.singleDeletes.CompareAndSwap(false, true) {
+		slog.Warn("Provider doesn't support multi-object delete, falling back to single DeleteObject calls", "error", err)
+	}
+}
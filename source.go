@@ -0,0 +1,749 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// keyPageSize is how many keys from an external source are submitted to the
+// purger at once, mirroring a ListObjectsV2 page.
+const keyPageSize = 1000
+
+// listPrefix lists everything under the prefix (or the whole bucket), either
+// current objects or every version depending on the purge mode.
+func listPrefix(ctx context.Context, p *purger, prefix string) error {
+	return listRange(ctx, p, keyRange{prefix: prefix})
+}
+
+// listRange lists the keys in part of a prefix like listPrefix.
+func listRange(ctx context.Context, p *purger, r keyRange) error {
+	var err error
+	if p.versioned {
+		_, err = listVersions(ctx, p, r, "")
+	} else {
+		_, err = listObjects(ctx, p, r, "")
+	}
+	return err
+}
+
+// listLevel lists under the prefix like listPrefix, but with a delimiter
+// only the objects directly under the prefix are submitted, and the common
+// prefixes beneath it are returned instead.
+func listLevel(ctx context.Context, p *purger, prefix, delimiter string) ([]string, error) {
+	if p.versioned {
+		return listVersions(ctx, p, keyRange{prefix: prefix}, delimiter)
+	}
+	return listObjects(ctx, p, keyRange{prefix: prefix}, delimiter)
+}
+
+// keyRange is the part of a listing under prefix that comes after the key
+// after and up to and including the key until. Empty bounds are the start
+// and end of the prefix.
+type keyRange struct {
+	prefix string
+	after  string
+	until  string
+}
+
+// String identifies the range in errors, and in checkpoints, where a whole
+// prefix is just the prefix.
+func (r keyRange) String() string {
+	if r.after == "" && r.until == "" {
+		return r.prefix
+	}
+	return fmt.Sprintf("%s(%s..%s]", r.prefix, r.after, r.until)
+}
+
+// split returns how many of the keys, in listing order, are within the
+// range, and whether the listing has gone past its end.
+func (r keyRange) split(n int, key func(int) string) (int, bool) {
+	if r.until == "" {
+		return n, false
+	}
+	i := sort.Search(n, func(i int) bool { return key(i) > r.until })
+	return i, i < n
+}
+
+// serverPrefix returns the prefix to send with listing requests. Server-side
+// prefixes are case-sensitive, so with --ignoreCase only the uncased start
+// of the prefix is sent and the rest is checked by scopeToPrefix.
+func serverPrefix(p *purger, prefix string) string {
+	if p.filter.ignoreCase {
+		return caseInsensitiveListPrefix(prefix)
+	}
+	return prefix
+}
+
+// scopeToPrefix drops listed objects outside the prefix when only part of it
+// could be sent to the server.
+func scopeToPrefix(objects []object, prefix, listPrefix string) []object {
+	if listPrefix == prefix {
+		return objects
+	}
+	scoped := objects[:0]
+	for _, item := range objects {
+		if hasPrefix(aws.ToString(item.Key), prefix, true) {
+			scoped = append(scoped, item)
+		}
+	}
+	return scoped
+}
+
+// listObjects lists every current object in the bucket (or under the
+// prefix) and submits each page to the purger.
+func listObjects(ctx context.Context, p *purger, r keyRange, delimiter string) ([]string, error) {
+	prefix := r.prefix
+	listPrefix := serverPrefix(p, prefix)
+
+	// Paginator to list all the objects in the bucket (or under the prefix)
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: &p.bucketName,
+	}
+	if listPrefix != "" {
+		listInput.Prefix = &listPrefix
+	}
+	if delimiter != "" {
+		listInput.Delimiter = &delimiter
+	}
+	if len(p.filter.owners) > 0 {
+		listInput.FetchOwner = true
+	}
+	if p.filter.skipRestoring {
+		listInput.OptionalObjectAttributes = []types.OptionalObjectAttributes{types.OptionalObjectAttributesRestoreStatus}
+	}
+	// Only full listings are checkpointed, a delimited one is cheap to redo
+	checkpoint := p.checkpoint
+	if delimiter != "" {
+		checkpoint = nil
+	}
+	after, done := checkpoint.resumeAfter(r.String())
+	if done {
+		return nil, nil
+	}
+	after = max(after, r.after)
+	if after != "" {
+		listInput.StartAfter = &after
+	}
+	paginator := s3.NewListObjectsV2Paginator(p.svc, listInput)
+	queue := newPageQueue(ctx, p)
+	defer queue.close()
+	defer p.listing.done(r.String())
+
+	var common []string
+	for paginator.HasMorePages() {
+		output, err := nextPage(ctx, p, paginator.NextPage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects%s: %w", listedUpTo(after), err)
+		}
+		common = appendCommonPrefixes(common, output.CommonPrefixes)
+		n, end := r.split(len(output.Contents), func(i int) string { return aws.ToString(output.Contents[i].Key) })
+		contents := output.Contents[:n]
+		var then func()
+		if n > 0 {
+			after = aws.ToString(contents[n-1].Key)
+			p.listing.advance(r.String(), after)
+			pos := after
+			then = func() { checkpoint.advance(r.String(), pos) }
+		}
+		queue.push(scopeToPrefix(objectsFromListing(contents), prefix, listPrefix), then)
+		if p.done() {
+			return common, nil
+		}
+		if end {
+			break
+		}
+	}
+	queue.close()
+	if !p.done() {
+		checkpoint.finish(r.String())
+	}
+	return common, nil
+}
+
+// listVersions lists every version and delete marker in the bucket (or
+// under the prefix) and submits each page to the purger.
+func listVersions(ctx context.Context, p *purger, r keyRange, delimiter string) ([]string, error) {
+	prefix := r.prefix
+	listPrefix := serverPrefix(p, prefix)
+
+	listInput := &s3.ListObjectVersionsInput{
+		Bucket: &p.bucketName,
+	}
+	if listPrefix != "" {
+		listInput.Prefix = &listPrefix
+	}
+	if delimiter != "" {
+		listInput.Delimiter = &delimiter
+	}
+	if p.filter.skipRestoring {
+		listInput.OptionalObjectAttributes = []types.OptionalObjectAttributes{types.OptionalObjectAttributesRestoreStatus}
+	}
+	// Positions are only saved at key boundaries, so --keepVersions and
+	// --orphanMarkersOnly see each key's whole history after resuming
+	checkpoint := p.checkpoint
+	if delimiter != "" {
+		checkpoint = nil
+	}
+	after, done := checkpoint.resumeAfter(r.String())
+	if done {
+		return nil, nil
+	}
+	after = max(after, r.after)
+	if after != "" {
+		listInput.KeyMarker = &after
+	}
+	paginator := s3.NewListObjectVersionsPaginator(p.svc, listInput)
+	queue := newPageQueue(ctx, p)
+	defer queue.close()
+	defer p.listing.done(r.String())
+
+	// With --keepVersions, the newest version records of each key are held
+	// back. Listings are ordered by key and then newest first, so a running
+	// count per key is enough even when a key's history spans pages.
+	var currentKey string
+	var seen int
+
+	// With --orphanMarkersOnly, the records of the last key on each page are
+	// held back, since the key's history may continue on the next page.
+	var held []object
+
+	var common []string
+	for paginator.HasMorePages() {
+		output, err := nextPage(ctx, p, paginator.NextPage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list object versions%s: %w", listedUpTo(after), err)
+		}
+		common = appendCommonPrefixes(common, output.CommonPrefixes)
+		// Versions and delete markers are each in key order
+		nv, endVersions := r.split(len(output.Versions), func(i int) string { return aws.ToString(output.Versions[i].Key) })
+		nm, endMarkers := r.split(len(output.DeleteMarkers), func(i int) string { return aws.ToString(output.DeleteMarkers[i].Key) })
+		end := endVersions || endMarkers
+		page := make([]object, 0, nv+nm)
+		for _, v := range output.Versions[:nv] {
+			page = append(page, objectFromVersion(v))
+		}
+		for _, m := range output.DeleteMarkers[:nm] {
+			page = append(page, objectFromDeleteMarker(m))
+		}
+
+		if p.keepVersions > 0 {
+			sortVersions(page)
+			kept := page[:0]
+			for _, item := range page {
+				if key := aws.ToString(item.Key); key != currentKey {
+					currentKey, seen = key, 0
+				}
+				seen++
+				if seen > p.keepVersions {
+					kept = append(kept, item)
+				}
+			}
+			page = kept
+		}
+		if p.orphanMarkers {
+			sortVersions(page)
+			page, held = orphanMarkers(append(held, page...), false)
+		}
+
+		var then func()
+		if key := lastCompleteKey(output); key != "" && !end {
+			after = key
+			p.listing.advance(r.String(), key)
+			then = func() { checkpoint.advance(r.String(), key) }
+		}
+		queue.push(scopeToPrefix(page, prefix, listPrefix), then)
+		if p.done() {
+			return common, nil
+		}
+		if end {
+			break
+		}
+	}
+	if len(held) > 0 {
+		orphans, _ := orphanMarkers(held, true)
+		queue.push(scopeToPrefix(orphans, prefix, listPrefix), nil)
+	}
+	queue.close()
+	if !p.done() {
+		checkpoint.finish(r.String())
+	}
+	return common, nil
+}
+
+// lastCompleteKey returns the last key on a version listing page whose
+// history is known to end on the page, or "" if there is none. The page's
+// final key may continue on the next page.
+func lastCompleteKey(output *s3.ListObjectVersionsOutput) string {
+	var last, complete string
+	consider := func(key *string) {
+		k := aws.ToString(key)
+		switch {
+		case k > last:
+			complete, last = last, k
+		case k < last && k > complete:
+			complete = k
+		}
+	}
+	for _, v := range output.Versions {
+		consider(v.Key)
+	}
+	for _, m := range output.DeleteMarkers {
+		consider(m.Key)
+	}
+	return complete
+}
+
+// listedUpTo describes how far a failed listing got, so it can be picked up
+// from there.
+func listedUpTo(after string) string {
+	if after == "" {
+		return ""
+	}
+	return fmt.Sprintf(" after key %q", after)
+}
+
+func appendCommonPrefixes(common []string, prefixes []types.CommonPrefix) []string {
+	for _, cp := range prefixes {
+		common = append(common, aws.ToString(cp.Prefix))
+	}
+	return common
+}
+
+// orphanMarkers returns the records of keys that have only delete markers
+// left, from records in listing order. Unless final is set, the records of
+// the last key are returned separately as rest, to be prepended to the next
+// page.
+func orphanMarkers(records []object, final bool) (orphans, rest []object) {
+	for start := 0; start < len(records); {
+		key := aws.ToString(records[start].Key)
+		end, hasVersions := start, false
+		for end < len(records) && aws.ToString(records[end].Key) == key {
+			hasVersions = hasVersions || !records[end].DeleteMarker
+			end++
+		}
+		if end == len(records) && !final {
+			return orphans, append([]object(nil), records[start:]...)
+		}
+		if !hasVersions {
+			orphans = append(orphans, records[start:end]...)
+		}
+		start = end
+	}
+	return orphans, nil
+}
+
+// sortVersions merges the versions and delete markers of a listing page back
+// into listing order: by key, then newest first.
+func sortVersions(page []object) {
+	sort.SliceStable(page, func(i, j int) bool {
+		ki, kj := aws.ToString(page[i].Key), aws.ToString(page[j].Key)
+		if ki != kj {
+			return ki < kj
+		}
+		if page[i].IsLatest != page[j].IsLatest {
+			return page[i].IsLatest
+		}
+		return aws.ToTime(page[i].LastModified).After(aws.ToTime(page[j].LastModified))
+	})
+}
+
+// listPrefixesFrom lists every prefix named in a file, up to concurrency at
+// a time. Prefixes nested within another listed prefix are dropped so no key
+// is listed twice.
+func listPrefixesFrom(ctx context.Context, p *purger, path string, concurrency int) error {
+	prefixes, err := readPrefixes(path, p.filter.ignoreCase)
+	if err != nil {
+		return err
+	}
+	return listPrefixesParallel(ctx, p, prefixes, concurrency)
+}
+
+// listKeyRanges splits the prefix into key ranges at every combination of
+// depth characters from the alphabet, and lists the ranges up to
+// concurrency at a time. Bounds only decide where each range starts and
+// ends, so keys using other characters are still listed, just not spread
+// evenly. That suits keys starting with a hash or random ID.
+func listKeyRanges(ctx context.Context, p *purger, prefix, alphabet string, depth, concurrency int) error {
+	return listRangesParallel(ctx, p, keyRanges(prefix, serverPrefix(p, prefix), alphabet, depth), concurrency)
+}
+
+// maxKeyRanges bounds how many ranges --shardAlphabet may split a prefix into.
+const maxKeyRanges = 100000
+
+// keyRangeCount returns how many ranges keyRanges makes, stopping once it's
+// past maxKeyRanges.
+func keyRangeCount(alphabet string, depth int) int {
+	chars := map[rune]bool{}
+	for _, c := range alphabet {
+		chars[c] = true
+	}
+	n := 1
+	for i := 0; i < depth && n <= maxKeyRanges; i++ {
+		n *= len(chars)
+	}
+	return n + 1
+}
+
+// keyRanges splits a prefix into consecutive ranges covering every key
+// under it, with bounds made of depth characters from the alphabet after
+// the listing prefix.
+func keyRanges(prefix, listPrefix, alphabet string, depth int) []keyRange {
+	chars := strings.Split(alphabet, "")
+	sort.Strings(chars)
+	bounds := []string{""}
+	for i := 0; i < depth; i++ {
+		next := make([]string, 0, len(bounds)*len(chars))
+		for _, bound := range bounds {
+			for j, c := range chars {
+				if j == 0 || c != chars[j-1] {
+					next = append(next, bound+c)
+				}
+			}
+		}
+		bounds = next
+	}
+
+	ranges := make([]keyRange, 0, len(bounds)+1)
+	after := ""
+	for _, bound := range bounds {
+		ranges = append(ranges, keyRange{prefix: prefix, after: after, until: listPrefix + bound})
+		after = listPrefix + bound
+	}
+	return append(ranges, keyRange{prefix: prefix, after: after})
+}
+
+// listSharded splits the prefix into shards at the next "/" and lists the
+// shards up to concurrency at a time. Objects directly under the prefix are
+// submitted while discovering the shards.
+func listSharded(ctx context.Context, p *purger, prefix string, concurrency int) error {
+	if concurrency < 1 {
+		return fmt.Errorf("--listConcurrency must be at least 1")
+	}
+	listed, err := listLevel(ctx, p, prefix, "/")
+	if err != nil {
+		return err
+	}
+	// With --ignoreCase, shards come from a shorter listing prefix and some
+	// may be unrelated to the prefix
+	shards := listed[:0]
+	for _, shard := range listed {
+		if hasPrefix(shard, prefix, p.filter.ignoreCase) || hasPrefix(prefix, shard, p.filter.ignoreCase) {
+			shards = append(shards, shard)
+		}
+	}
+	if len(shards) == 0 {
+		return nil
+	}
+	return listPrefixesParallel(ctx, p, shards, concurrency)
+}
+
+// listPrefixesParallel lists each prefix, up to concurrency at a time.
+func listPrefixesParallel(ctx context.Context, p *purger, prefixes []string, concurrency int) error {
+	ranges := make([]keyRange, len(prefixes))
+	for i, prefix := range prefixes {
+		ranges[i] = keyRange{prefix: prefix}
+	}
+	return listRangesParallel(ctx, p, ranges, concurrency)
+}
+
+// listRangesParallel lists each key range, up to concurrency at a time.
+func listRangesParallel(ctx context.Context, p *purger, ranges []keyRange, concurrency int) error {
+	if concurrency < 1 {
+		return fmt.Errorf("--listConcurrency must be at least 1")
+	}
+	slog.Info("listing prefixes", "count", len(ranges), "listConcurrency", concurrency)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	sem := make(chan struct{}, concurrency)
+	for _, r := range ranges {
+		if p.done() {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r keyRange) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := listRange(ctx, p, r); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("prefix %q: %w", r, err))
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// readPrefixes reads a prefix file, skipping blank lines and # comments, and
+// returns the sorted prefixes with any that are covered by a shorter one
+// removed. With ignoreCase, prefixes are lowercased so that variants that
+// differ only in case are also deduplicated.
+func readPrefixes(path string, ignoreCase bool) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open prefix file: %w", err)
+	}
+	defer f.Close()
+
+	var prefixes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if ignoreCase {
+			line = strings.ToLower(line)
+		}
+		prefixes = append(prefixes, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read prefix file: %w", err)
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("prefix file %s is empty", path)
+	}
+
+	sort.Strings(prefixes)
+	out := prefixes[:1]
+	for _, prefix := range prefixes[1:] {
+		if !strings.HasPrefix(prefix, out[len(out)-1]) {
+			out = append(out, prefix)
+		}
+	}
+	return out, nil
+}
+
+// readKeys submits keys read from a file instead of listing the bucket.
+// Files ending in .csv are parsed as CSV with a header row, and keys are
+// taken from the named column, along with version IDs if the header has a
+// versionColumn. Files ending in .jsonl or .ndjson hold one {"key": ...,
+// "versionId": ...} object per line. Anything else is read as one key per
+// line.
+//
+// A path of "-" streams keys from stdin. Since producers may be slow, any
+// partial batch is flushed once no new key has arrived for idleFlush.
+func readKeys(ctx context.Context, p *purger, path, column, versionColumn string, idleFlush time.Duration) error {
+	if path == "-" {
+		if idleFlush <= 0 {
+			return fmt.Errorf("--idleFlush must be positive")
+		}
+		return streamLineKeys(ctx, p, os.Stdin, idleFlush)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open key file: %w", err)
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return readCSVKeys(ctx, p, f, column, versionColumn)
+	case ".jsonl", ".ndjson":
+		return readJSONLKeys(ctx, p, f)
+	}
+	return readLineKeys(ctx, p, f)
+}
+
+func readLineKeys(ctx context.Context, p *purger, r io.Reader) error {
+	var page []object
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		key := strings.TrimSuffix(scanner.Text(), "\r")
+		if key == "" {
+			continue
+		}
+		page = append(page, keyObject(key))
+		if len(page) == keyPageSize {
+			p.submit(ctx, page, true)
+			page = nil
+			if p.done() {
+				return nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read keys: %w", err)
+	}
+	if len(page) > 0 {
+		p.submit(ctx, page, true)
+	}
+	return nil
+}
+
+func streamLineKeys(ctx context.Context, p *purger, r io.Reader, idleFlush time.Duration) error {
+	lines := make(chan string, keyPageSize)
+	// Closed on return, so the reader doesn't block forever on lines nobody
+	// takes once the run is done
+	stop := make(chan struct{})
+	defer close(stop)
+	var scanErr error
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-stop:
+				return
+			}
+		}
+		scanErr = scanner.Err()
+	}()
+
+	idle := time.NewTimer(idleFlush)
+	defer idle.Stop()
+
+	var page []object
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				// EOF, scanErr is safe to read once the channel is closed
+				if len(page) > 0 {
+					p.submit(ctx, page, true)
+				}
+				if scanErr != nil {
+					return fmt.Errorf("failed to read keys: %w", scanErr)
+				}
+				return nil
+			}
+			key := strings.TrimSuffix(line, "\r")
+			if key == "" {
+				continue
+			}
+			page = append(page, keyObject(key))
+			if len(page) == keyPageSize {
+				p.submit(ctx, page, true)
+				page = nil
+				if p.done() {
+					return nil
+				}
+			}
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(idleFlush)
+		case <-idle.C:
+			// The producer has gone quiet, don't leave keys waiting on it
+			if len(page) > 0 {
+				p.submit(ctx, page, true)
+				page = nil
+			}
+			p.flush()
+			idle.Reset(idleFlush)
+		}
+	}
+}
+
+func readCSVKeys(ctx context.Context, p *purger, r io.Reader, column, versionColumn string) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	col := csvColumn(header, column)
+	if col < 0 {
+		return fmt.Errorf("CSV header has no %q column", column)
+	}
+	versionCol := csvColumn(header, versionColumn)
+
+	var page []object
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read CSV record: %w", err)
+		}
+		if col >= len(record) || record[col] == "" {
+			continue
+		}
+		var versionId string
+		if versionCol >= 0 && versionCol < len(record) {
+			versionId = record[versionCol]
+		}
+		page = append(page, keyVersionObject(record[col], versionId))
+		if len(page) == keyPageSize {
+			p.submit(ctx, page, true)
+			page = nil
+			if p.done() {
+				return nil
+			}
+		}
+	}
+	if len(page) > 0 {
+		p.submit(ctx, page, true)
+	}
+	return nil
+}
+
+// csvColumn returns the index of the named column in a CSV header, or -1.
+func csvColumn(header []string, column string) int {
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), column) {
+			return i
+		}
+	}
+	return -1
+}
+
+func readJSONLKeys(ctx context.Context, p *purger, r io.Reader) error {
+	var page []object
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var entry manifestEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read manifest entry %d: %w", n, err)
+		}
+		if entry.Key == "" {
+			continue
+		}
+		page = append(page, keyVersionObject(entry.Key, entry.VersionId))
+		if len(page) == keyPageSize {
+			p.submit(ctx, page, true)
+			page = nil
+			if p.done() {
+				return nil
+			}
+		}
+	}
+	if len(page) > 0 {
+		p.submit(ctx, page, true)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc/types"
+	"github.com/urfave/cli/v2"
+)
+
+// ssoLogin describes the IAM Identity Center sign-in of a shared config
+// profile. Profiles with an sso-session cache their token under the
+// session's name and can refresh it, legacy ones under the start URL.
+type ssoLogin struct {
+	profile  string
+	session  string
+	startURL string
+	region   string
+}
+
+// ssoLoginFor returns the SSO sign-in of the profile the credentials come
+// from, or nil if it doesn't use SSO.
+func ssoLoginFor(ctx context.Context, c *cli.Context) *ssoLogin {
+	name := c.String("profile")
+	if name == "" {
+		name = os.Getenv("AWS_PROFILE")
+	}
+	if name == "" {
+		name = "default"
+	}
+	profile, err := config.LoadSharedConfigProfile(ctx, name)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case profile.SSOSession != nil:
+		return &ssoLogin{profile: name, session: profile.SSOSession.Name, startURL: profile.SSOSession.SSOStartURL, region: profile.SSOSession.SSORegion}
+	case profile.SSOStartURL != "":
+		return &ssoLogin{profile: name, startURL: profile.SSOStartURL, region: profile.SSORegion}
+	}
+	return nil
+}
+
+// ssoToken is the SDK's cached SSO token file.
+type ssoToken struct {
+	StartURL              string     `json:"startUrl"`
+	Region                string     `json:"region"`
+	AccessToken           string     `json:"accessToken"`
+	ExpiresAt             time.Time  `json:"expiresAt"`
+	ClientID              string     `json:"clientId,omitempty"`
+	ClientSecret          string     `json:"clientSecret,omitempty"`
+	RegistrationExpiresAt *time.Time `json:"registrationExpiresAt,omitempty"`
+	RefreshToken          string     `json:"refreshToken,omitempty"`
+}
+
+func (l *ssoLogin) cachePath() (string, error) {
+	if l.session != "" {
+		return ssocreds.StandardCachedTokenFilepath(l.session)
+	}
+	return ssocreds.StandardCachedTokenFilepath(l.startURL)
+}
+
+// expired reports whether the cached token is missing or has expired, in
+// which case the SDK can't get credentials without a new sign-in.
+func (l *ssoLogin) expired() bool {
+	path, err := l.cachePath()
+	if err != nil {
+		return false
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	var token ssoToken
+	if err != nil || json.Unmarshal(data, &token) != nil {
+		return false
+	}
+	return !time.Now().Before(token.ExpiresAt)
+}
+
+// run signs in with the device authorization flow, as `aws sso login` does:
+// the operator is shown a URL and code on the terminal to approve in a
+// browser, and the resulting token is cached where the SDK looks for it.
+func (l *ssoLogin) run(ctx context.Context, httpClient aws.HTTPClient) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("the SSO sign-in of profile %s has expired and no terminal is available to sign in again on, run aws sso login --profile %s", l.profile, l.profile)
+	}
+	defer tty.Close()
+
+	client := ssooidc.New(ssooidc.Options{Region: l.region, HTTPClient: httpClient})
+	register := &ssooidc.RegisterClientInput{ClientName: aws.String("s3purge"), ClientType: aws.String("public")}
+	if l.session != "" {
+		register.Scopes = []string{"sso:account:access"}
+	}
+	registration, err := client.RegisterClient(ctx, register)
+	if err != nil {
+		return fmt.Errorf("failed to start the SSO sign-in: %w", err)
+	}
+	device, err := client.StartDeviceAuthorization(ctx, &ssooidc.StartDeviceAuthorizationInput{
+		ClientId:     registration.ClientId,
+		ClientSecret: registration.ClientSecret,
+		StartUrl:     &l.startURL,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start the SSO sign-in: %w", err)
+	}
+	fmt.Fprintf(tty, "The SSO sign-in of profile %s has expired. To sign in again, open\n\n    %s\n\nand check that it shows the code %s.\n", l.profile, aws.ToString(device.VerificationUriComplete), aws.ToString(device.UserCode))
+
+	interval := time.Duration(max(1, device.Interval)) * time.Second
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	for {
+		time.Sleep(interval)
+		output, err := client.CreateToken(ctx, &ssooidc.CreateTokenInput{
+			ClientId:     registration.ClientId,
+			ClientSecret: registration.ClientSecret,
+			DeviceCode:   device.DeviceCode,
+			GrantType:    aws.String("urn:ietf:params:oauth:grant-type:device_code"),
+		})
+		var pending *types.AuthorizationPendingException
+		var slowDown *types.SlowDownException
+		switch {
+		case errors.As(err, &pending):
+		case errors.As(err, &slowDown):
+			interval += 5 * time.Second
+		case err != nil:
+			return fmt.Errorf("SSO sign-in failed: %w", err)
+		default:
+			token := ssoToken{
+				StartURL:    l.startURL,
+				Region:      l.region,
+				AccessToken: aws.ToString(output.AccessToken),
+				ExpiresAt:   time.Now().Add(time.Duration(output.ExpiresIn) * time.Second).UTC().Truncate(time.Second),
+			}
+			// Only sso-session profiles refresh their token
+			if l.session != "" {
+				token.ClientID = aws.ToString(registration.ClientId)
+				token.ClientSecret = aws.ToString(registration.ClientSecret)
+				token.RegistrationExpiresAt = aws.Time(time.Unix(registration.ClientSecretExpiresAt, 0).UTC())
+				token.RefreshToken = aws.ToString(output.RefreshToken)
+			}
+			fmt.Fprintln(tty, "Signed in.")
+			return l.save(token)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("SSO sign-in wasn't approved in time")
+		}
+	}
+}
+
+func (l *ssoLogin) save(token ssoToken) error {
+	path, err := l.cachePath()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to encode the SSO token: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to cache the SSO token: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to cache the SSO token: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import "sync/atomic"
+
+// purgeStats holds the counters shared by all deletion workers.
+type purgeStats struct {
+	deleted atomic.Uint64
+	bytes   atomic.Uint64
+	// Deletions by prefix (--prefixStats), or nil
+	prefixes *prefixSummary
+}
+
+// recordDeleted accounts for a successfully deleted batch.
+func (s *purgeStats) recordDeleted(objects []object) {
+	var size uint64
+	for _, obj := range objects {
+		size += uint64(obj.Size)
+	}
+	s.deleted.Add(uint64(len(objects)))
+	s.bytes.Add(size)
+	if s.prefixes != nil {
+		s.prefixes.record(objects)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// listingPositions tracks the last key listed by each listing in progress,
+// by prefix or key range, i.e. where each would carry on from.
+type listingPositions struct {
+	mu    sync.Mutex
+	after map[string]string
+}
+
+func (l *listingPositions) advance(name, after string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.after == nil {
+		l.after = make(map[string]string)
+	}
+	l.after[name] = after
+}
+
+// done forgets a listing once it has finished.
+func (l *listingPositions) done(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.after, name)
+}
+
+func (l *listingPositions) snapshot() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	positions := make(map[string]string, len(l.after))
+	for name, after := range l.after {
+		positions[name] = after
+	}
+	return positions
+}
+
+// runStatus is the state of a run in progress, served by --statusAddr.
+type runStatus struct {
+	// running, or stopping once the run has been aborted or interrupted
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	DryRun   bool   `json:"dryRun"`
+
+	Started        time.Time `json:"started"`
+	ElapsedSeconds float64   `json:"elapsedSeconds"`
+	Rate           float64   `json:"rate"`
+	AverageRate    float64   `json:"averageRate"`
+	Percent        float64   `json:"percent,omitempty"`
+	Remaining      uint64    `json:"remaining,omitempty"`
+	ETASeconds     float64   `json:"etaSeconds,omitempty"`
+
+	Deleted        uint64            `json:"deleted"`
+	Bytes          uint64            `json:"bytes"`
+	Skipped        uint64            `json:"skipped"`
+	AlreadyDeleted uint64            `json:"alreadyDeleted"`
+	LookupErrors   uint64            `json:"lookupErrors"`
+	Failed         uint64            `json:"failed"`
+	FailedBatches  uint64            `json:"failedBatches"`
+	FailuresByCode map[string]uint64 `json:"failuresByCode"`
+
+	Concurrency     int               `json:"concurrency"`
+	BatchesInFlight int               `json:"batchesInFlight"`
+	ListPages       uint64            `json:"listPages"`
+	ListedUpTo      map[string]string `json:"listedUpTo"`
+}
+
+// serveStatus serves the state of the run as JSON on addr for the rest of
+// the process, at /status, along with a /healthz liveness check. The rate is
+// measured over the window between polls, like the progress log's, and the
+// percentage done and ETA are given when the number of objects to delete is
+// known (expected > 0). Listening happens up front so a bad address fails
+// the run straight away.
+func serveStatus(addr, endpoint string, p *purger, start time.Time, window time.Duration, expected uint64) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on --statusAddr: %w", err)
+	}
+
+	// Polls may overlap
+	var mu sync.Mutex
+	w := &rateWindow{window: window}
+	w.add(start, 0)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		deleted := p.stats.deleted.Load()
+		mu.Lock()
+		w.add(now, deleted)
+		rate := w.rate()
+		mu.Unlock()
+
+		s := &runStatus{
+			Status:   "running",
+			Endpoint: endpoint,
+			Bucket:   p.bucketName,
+			DryRun:   p.dryRun,
+
+			Started:        start.UTC(),
+			ElapsedSeconds: now.Sub(start).Seconds(),
+			Rate:           roundRate(rate),
+			AverageRate:    roundRate(float64(deleted) / now.Sub(start).Seconds()),
+
+			Deleted:        deleted,
+			Bytes:          p.stats.bytes.Load(),
+			Skipped:        p.skipped.Load(),
+			AlreadyDeleted: p.alreadyGone.Load(),
+			LookupErrors:   p.lookupErrors.Load(),
+			Failed:         p.failures.total(),
+			FailedBatches:  p.failedBatches.Load(),
+			FailuresByCode: make(map[string]uint64),
+
+			Concurrency:     p.throttle.current(),
+			BatchesInFlight: p.throttle.active(),
+			ListPages:       p.listPages.Load(),
+			ListedUpTo:      p.listing.snapshot(),
+		}
+		if expected > 0 {
+			s.Percent = percentDone(deleted, expected)
+		}
+		if expected > deleted {
+			s.Remaining = expected - deleted
+			if rate > 0 {
+				s.ETASeconds = float64(s.Remaining) / rate
+			}
+		}
+		for _, f := range p.failures.byCode() {
+			s.FailuresByCode[f.code] = f.count
+		}
+		if err := p.aborted(); err != nil {
+			s.Status = "stopping"
+			s.Error = err.Error()
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.SetIndent("", "  ")
+		enc.Encode(s)
+	})
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(rw, "ok")
+	})
+
+	slog.Info("Serving status", "url", fmt.Sprintf("http://%s/status", ln.Addr()))
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("status server stopped", "error", err)
+		}
+	}()
+	return nil
+}
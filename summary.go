@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// maxSummaryRows bounds how many prefixes the pre-purge summary lists; the
+// rest are folded into a single row.
+const maxSummaryRows = 50
+
+// prefixUsage is the number and total size of matching objects under one
+// prefix.
+type prefixUsage struct {
+	prefix  string
+	objects uint64
+	bytes   uint64
+}
+
+// prefixSummary groups the objects a purge deletes (or would delete) by the
+// first depth path segments beneath the purge prefix, similar to du. Writes
+// may come from several batches at once.
+type prefixSummary struct {
+	prefix string
+	depth  int
+
+	mu     sync.Mutex
+	groups map[string]*prefixUsage
+}
+
+func newPrefixSummary(prefix string, depth int) *prefixSummary {
+	return &prefixSummary{prefix: prefix, depth: depth, groups: make(map[string]*prefixUsage)}
+}
+
+func (s *prefixSummary) record(objects []object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, obj := range objects {
+		group := s.group(aws.ToString(obj.Key))
+		usage, ok := s.groups[group]
+		if !ok {
+			usage = &prefixUsage{prefix: group}
+			s.groups[group] = usage
+		}
+		usage.objects++
+		usage.bytes += uint64(obj.Size)
+	}
+}
+
+// group returns the prefix a key is summarized under: the purge prefix plus
+// up to depth of the key's next path segments, or the purge prefix itself
+// for keys directly beneath it.
+func (s *prefixSummary) group(key string) string {
+	if len(key) < len(s.prefix) {
+		return s.prefix
+	}
+	rest := key[len(s.prefix):]
+	end := 0
+	for i := 0; i < s.depth; i++ {
+		j := strings.Index(rest[end:], "/")
+		if j < 0 {
+			break
+		}
+		end += j + 1
+	}
+	return key[:len(s.prefix)+end]
+}
+
+// name describes a group for humans.
+func (s *prefixSummary) name(group string) string {
+	if group == s.prefix {
+		return "(objects directly under " + displayPrefix(s.prefix) + ")"
+	}
+	return group
+}
+
+// top describes the n prefixes with the most objects, for the progress log.
+func (s *prefixSummary) top(n int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := make([]*prefixUsage, 0, len(s.groups))
+	for _, usage := range s.groups {
+		rows = append(rows, usage)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].objects != rows[j].objects {
+			return rows[i].objects > rows[j].objects
+		}
+		return rows[i].prefix < rows[j].prefix
+	})
+	parts := make([]string, 0, n)
+	for _, usage := range rows[:min(n, len(rows))] {
+		parts = append(parts, fmt.Sprintf("%s=%d", s.name(usage.prefix), usage.objects))
+	}
+	return strings.Join(parts, " ")
+}
+
+// print writes the summary, largest prefixes first.
+func (s *prefixSummary) print(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows := make([]*prefixUsage, 0, len(s.groups))
+	var total prefixUsage
+	for _, usage := range s.groups {
+		rows = append(rows, usage)
+		total.objects += usage.objects
+		total.bytes += usage.bytes
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].bytes != rows[j].bytes {
+			return rows[i].bytes > rows[j].bytes
+		}
+		return rows[i].prefix < rows[j].prefix
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "SIZE\tOBJECTS\t\tPREFIX")
+	for i, usage := range rows {
+		if i == maxSummaryRows {
+			var rest prefixUsage
+			for _, usage := range rows[i:] {
+				rest.objects += usage.objects
+				rest.bytes += usage.bytes
+			}
+			fmt.Fprintf(tw, "%s\t%d\t\t(%d more prefixes)\n", formatBytes(rest.bytes), rest.objects, len(rows)-i)
+			break
+		}
+		fmt.Fprintf(tw, "%s\t%d\t\t%s\n", formatBytes(usage.bytes), usage.objects, s.name(usage.prefix))
+	}
+	fmt.Fprintf(tw, "%s\t%d\t\ttotal\n", formatBytes(total.bytes), total.objects)
+	tw.Flush()
+}
+
+// displayPrefix names a prefix for humans, calling out the bucket root.
+func displayPrefix(prefix string) string {
+	if prefix == "" {
+		return "the bucket root"
+	}
+	return prefix
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// defaultSlowDownPause is how long deletions pause after a SlowDown that
+// came without a Retry-After hint.
+const defaultSlowDownPause = 5 * time.Second
+
+// With --concurrency auto, deletion starts at autoConcurrencyStart batches
+// in flight and is never allowed more than autoConcurrencyMax.
+const (
+	autoConcurrencyStart = 8
+	autoConcurrencyMax   = 1000
+)
+
+// autoBackoffCooldown is how long after halving the limit in auto mode
+// further throttled calls are taken as part of the same burst, since the
+// calls already in flight answer throttled too. It's roughly the time a
+// batch takes.
+const autoBackoffCooldown = 2 * time.Second
+
+// parseConcurrency parses --concurrency, which is either a number of
+// concurrent batches or "auto". For auto, the returned n is the upper bound.
+func parseConcurrency(s string) (n int, auto bool, err error) {
+	if s == "auto" {
+		return autoConcurrencyMax, true, nil
+	}
+	n, err = strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, false, fmt.Errorf("--concurrency must be a positive number or auto")
+	}
+	return n, false, nil
+}
+
+// throttle is a circuit breaker in front of DeleteObjects calls. When the
+// provider signals overload (503 SlowDown), new calls are held back for the
+// Retry-After period, then concurrency restarts at a single request and
+// doubles with each successful call until it's back at the maximum, rather
+// than hammering an already struggling endpoint at full concurrency.
+//
+// In auto mode the limit is tuned with AIMD instead: it grows by one for
+// every limit successful calls, roughly one per round of batches, and
+// halves whenever a call is throttled.
+type throttle struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	max         int
+	limit       int
+	inFlight    int
+	pausedUntil time.Time
+
+	auto      bool
+	successes int
+	// When the limit was last halved in auto mode
+	lastBackoff time.Time
+}
+
+func newThrottle(max int, auto bool) *throttle {
+	t := &throttle{max: max, limit: max, auto: auto}
+	if auto {
+		t.limit = min(max, autoConcurrencyStart)
+	}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// current returns the number of calls currently allowed in flight.
+func (t *throttle) current() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limit
+}
+
+// active returns the number of calls in flight.
+func (t *throttle) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.inFlight
+}
+
+// acquire blocks until a call may be made.
+func (t *throttle) acquire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		if wait := time.Until(t.pausedUntil); wait > 0 {
+			t.mu.Unlock()
+			time.Sleep(wait)
+			t.mu.Lock()
+			continue
+		}
+		if t.inFlight < t.limit {
+			t.inFlight++
+			return
+		}
+		t.cond.Wait()
+	}
+}
+
+// release records the outcome of a call made after acquire. A throttled
+// call trips the breaker for retryAfter (or defaultSlowDownPause if zero).
+func (t *throttle) release(throttled bool, retryAfter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight--
+	defer t.cond.Broadcast()
+
+	if t.auto {
+		t.adjustLocked(throttled, retryAfter)
+		return
+	}
+	if !throttled {
+		if t.limit < t.max && time.Now().After(t.pausedUntil) {
+			t.limit = min(t.max, t.limit*2)
+			if t.limit == t.max {
+				slog.Info("Deletion concurrency fully restored", "concurrency", t.max)
+			}
+		}
+		return
+	}
+
+	if retryAfter <= 0 {
+		retryAfter = defaultSlowDownPause
+	}
+	until := time.Now().Add(retryAfter)
+	if until.After(t.pausedUntil) {
+		if time.Now().After(t.pausedUntil) {
+			slog.Warn("Provider asked us to slow down, pausing deletions", "pause", retryAfter.Round(time.Millisecond))
+		}
+		t.pausedUntil = until
+	}
+	t.limit = 1
+}
+
+// adjustLocked applies AIMD to the limit in auto mode. A throttled call only
+// pauses deletions if the provider said for how long.
+func (t *throttle) adjustLocked(throttled bool, retryAfter time.Duration) {
+	if !throttled {
+		t.successes++
+		if t.successes >= t.limit && t.limit < t.max {
+			t.limit++
+			t.successes = 0
+		}
+		return
+	}
+
+	t.successes = 0
+	now := time.Now()
+	// Only back off once per burst of throttled calls
+	if now.Sub(t.lastBackoff) >= autoBackoffCooldown {
+		t.limit = max(1, t.limit/2)
+		t.lastBackoff = now
+		slog.Warn("Provider asked us to slow down, reducing concurrency", "concurrency", t.limit)
+	}
+	if until := now.Add(retryAfter); retryAfter > 0 && until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+}
+
+// throttlingCodes are error codes providers use to say they're overloaded.
+var throttlingCodes = map[string]bool{
+	"SlowDown":             true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestLimitExceeded": true,
+	"TooManyRequests":      true,
+}
+
+// slowDown reports whether a DeleteObjects call was throttled, either as a
+// whole or for any of its keys, along with the provider's Retry-After hint.
+func slowDown(err error, keyErrors []types.Error) (bool, time.Duration) {
+	if err != nil {
+		var respErr *smithyhttp.ResponseError
+		if errors.As(err, &respErr) {
+			if status := respErr.HTTPStatusCode(); status == http.StatusServiceUnavailable || status == http.StatusTooManyRequests {
+				return true, retryAfter(respErr.Response.Header.Get("Retry-After"))
+			}
+		}
+		return throttlingCodes[errorCode(err)], 0
+	}
+	for _, e := range keyErrors {
+		if throttlingCodes[aws.ToString(e.Code)] {
+			return true, 0
+		}
+	}
+	return false, 0
+}
+
+// retryAfter parses a Retry-After header, given in seconds or as an HTTP
+// date.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of listing pages, delete batches and S3 calls.
+// Until setupTracing installs a provider, its spans are no-ops.
+var tracer = otel.Tracer("github.com/ericvolp12/s3purge")
+
+// setupTracing exports spans to the OTLP/HTTP collector at endpoint, e.g.
+// http://localhost:4318. The returned function flushes the spans still
+// buffered and must be called before exiting.
+func setupTracing(ctx context.Context, endpoint string) (func(), error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up --otlpEndpoint: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "s3purge"))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Warn("failed to flush traces", "error", err)
+		}
+	}, nil
+}
+
+// tracingMiddleware wraps each attempt of an S3 request in a client span
+// carrying the provider's request IDs, so a slow or throttled call can be
+// looked up on the provider's side.
+func tracingMiddleware(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("Tracing", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		operation := awsmiddleware.GetOperationName(ctx)
+		ctx, span := tracer.Start(ctx, "S3."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+			attribute.String("rpc.system", "aws-api"),
+			attribute.String("rpc.service", "S3"),
+			attribute.String("rpc.method", operation),
+		))
+		defer span.End()
+
+		out, metadata, err := next.HandleFinalize(ctx, in)
+		if id, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+			span.SetAttributes(attribute.String("aws.request_id", id))
+		}
+		if id, ok := s3.GetHostIDMetadata(metadata); ok {
+			span.SetAttributes(attribute.String("aws.extended_request_id", id))
+		}
+		if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok && resp.Response != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, errorCode(err))
+		}
+		return out, metadata, err
+	}), middleware.After)
+}
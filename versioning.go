@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// refuseVersioned refuses a soft purge of a versioning-enabled bucket unless
+// the operator has said that's what they want, since it frees no space and
+// leaves every object recoverable behind a new delete marker. fromFile says
+// the keys come from --keysFrom or --retryFrom, where only those listed
+// without a version ID get delete markers.
+func refuseVersioned(ctx context.Context, svc *s3.Client, bucketName string, fromFile bool) error {
+	output, err := svc.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: &bucketName})
+	if err != nil {
+		// Not every provider supports versioning
+		slog.Debug("failed to get bucket versioning", "error", err)
+		return nil
+	}
+	if output.Status == types.BucketVersioningStatusEnabled && fromFile {
+		return fmt.Errorf("bucket versioning is enabled, so keys listed without a version ID would only be hidden behind delete markers; " +
+			"pass --allowVersioned to delete them anyway (listed version IDs are always deleted permanently)")
+	}
+	if output.Status == types.BucketVersioningStatusEnabled {
+		return fmt.Errorf("bucket versioning is enabled, so deleted objects would only be hidden behind delete markers; " +
+			"pass --allVersions (or --mode permanent) to delete every version, or --allowVersioned (or --mode soft) to create delete markers anyway")
+	}
+	return nil
+}
+
+// versioningSuspension remembers a bucket's versioning state so it can be
+// put back once the purge is over.
+type versioningSuspension struct {
+	svc        *s3.Client
+	bucketName string
+	mfa        *mfaProvider
+	mfaDelete  types.MFADelete
+
+	once sync.Once
+}
+
+// suspendVersioning suspends versioning on a bucket that has it enabled, so
+// the purge doesn't leave a delete marker behind for every key. The caller
+// must restore it, including when the process is interrupted. It returns nil
+// if versioning wasn't enabled in the first place.
+func suspendVersioning(ctx context.Context, svc *s3.Client, bucketName string, mfa *mfaProvider) (*versioningSuspension, error) {
+	output, err := svc.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: &bucketName})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bucket versioning: %w", err)
+	}
+	if output.Status != types.BucketVersioningStatusEnabled {
+		slog.Info("Bucket versioning isn't enabled, leaving it alone", "status", output.Status)
+		return nil, nil
+	}
+
+	v := &versioningSuspension{svc: svc, bucketName: bucketName, mfa: mfa}
+	if output.MFADelete == types.MFADeleteStatusEnabled {
+		v.mfaDelete = types.MFADeleteEnabled
+	}
+	if err := v.put(ctx, types.BucketVersioningStatusSuspended); err != nil {
+		return nil, fmt.Errorf("failed to suspend bucket versioning: %w", err)
+	}
+	slog.Info("Suspended bucket versioning for the purge")
+
+	return v, nil
+}
+
+// restore re-enables versioning. It's safe to call more than once, and from
+// the signal handler concurrently with the main goroutine. It does nothing on
+// a nil suspension.
+func (v *versioningSuspension) restore() {
+	if v == nil {
+		return
+	}
+	v.once.Do(func() {
+		if err := v.put(context.Background(), types.BucketVersioningStatusEnabled); err != nil {
+			slog.Error("failed to re-enable bucket versioning, it is still suspended", "bucket", v.bucketName, "error", err)
+			return
+		}
+		slog.Info("Re-enabled bucket versioning")
+	})
+}
+
+func (v *versioningSuspension) put(ctx context.Context, status types.BucketVersioningStatus) error {
+	input := &s3.PutBucketVersioningInput{
+		Bucket: &v.bucketName,
+		VersioningConfiguration: &types.VersioningConfiguration{
+			Status:    status,
+			MFADelete: v.mfaDelete,
+		},
+	}
+	if v.mfa != nil {
+		header, _ := v.mfa.header()
+		input.MFA = &header
+	}
+	_, err := v.svc.PutBucketVersioning(ctx, input)
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+// deleteBatch is a batch of objects for a worker to delete, and which
+// attempt at deleting them this is (1 for the first).
+type deleteBatch struct {
+	objects []object
+	attempt int
+}
+
+// startWorkers starts the pool of workers that delete batches, one per
+// concurrency slot. With --concurrency auto, the throttle keeps fewer of
+// them sending requests at once.
+func (p *purger) startWorkers() {
+	p.workers.Add(p.concurrency)
+	for i := 0; i < p.concurrency; i++ {
+		go func() {
+			defer p.workers.Done()
+			for batch := range p.queue {
+				p.deleteObjects(batch.objects, batch.attempt)
+			}
+		}()
+	}
+}
+
+// send hands a batch to the next free worker, blocking until there is one.
+// Workers never send batches themselves, since every worker could end up
+// blocked in send.
+func (p *purger) send(objects []object, attempt int) {
+	p.wg.Add(1)
+	p.queue <- deleteBatch{objects: objects, attempt: attempt}
+}
+
+// close waits for every batch, including retries, and stops the workers.
+// Nothing may be submitted afterwards.
+func (p *purger) close() {
+	p.wg.Wait()
+	close(p.queue)
+	p.workers.Wait()
+}